@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/a-h/jwtproxy/proxy"
+)
+
+// version is set at build time, e.g. go build -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// AdminHandler serves the admin endpoints, which must not be exposed to callers of the proxy.
+type AdminHandler struct {
+	Metrics *proxy.Metrics
+	// Settings are the effective configuration settings.
+	Settings []Setting
+	// Keys returns the issuer keys which are loaded.
+	Keys func() []proxy.KeyInfo
+	// Pprof is true if profiling data is served.
+	Pprof bool
+	mux   *http.ServeMux
+}
+
+// NewAdminHandler creates a handler serving Prometheus metrics at /metrics, the effective configuration at
+// /config, the key inventory at /keys and build information at /build. If servePprof is true, profiling
+// data is served at /debug/pprof/.
+func NewAdminHandler(metrics *proxy.Metrics, settings []Setting, keys func() []proxy.KeyInfo, servePprof bool) AdminHandler {
+	h := AdminHandler{
+		Metrics:  metrics,
+		Settings: settings,
+		Keys:     keys,
+		Pprof:    servePprof,
+		mux:      http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/", h.index)
+	if metrics != nil {
+		h.mux.Handle("/metrics", metrics.Handler())
+	}
+	if servePprof {
+		h.mux.HandleFunc("/debug/pprof/", pprof.Index)
+		h.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		h.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		h.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		h.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	h.mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, h.Settings)
+	})
+	h.mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, h.Keys())
+	})
+	h.mux.HandleFunc("/build", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, getBuildInfo())
+	})
+	return h
+}
+
+func (h AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h AdminHandler) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "/metrics")
+	if h.Pprof {
+		fmt.Fprintln(w, "/debug/pprof/")
+	}
+	fmt.Fprintln(w, "/config\n/keys\n/build")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// BuildInfo describes the running binary.
+type BuildInfo struct {
+	Version   string            `json:"version"`
+	GoVersion string            `json:"goVersion"`
+	Path      string            `json:"path,omitempty"`
+	Settings  map[string]string `json:"settings,omitempty"`
+	Hostname  string            `json:"hostname,omitempty"`
+}
+
+func getBuildInfo() BuildInfo {
+	bi := BuildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+	}
+	bi.Hostname, _ = os.Hostname()
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return bi
+	}
+	bi.Path = info.Main.Path
+	if bi.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		bi.Version = info.Main.Version
+	}
+	bi.Settings = map[string]string{}
+	for _, s := range info.Settings {
+		// Only include the version control details, since other settings (e.g. ldflags) may be sensitive.
+		switch s.Key {
+		case "vcs", "vcs.revision", "vcs.time", "vcs.modified":
+			bi.Settings[s.Key] = s.Value
+		}
+	}
+	return bi
+}
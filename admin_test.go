@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/a-h/jwtproxy/proxy"
+)
+
+func TestAdminHandler(t *testing.T) {
+	settings := []Setting{{Name: "port", Env: "JWTPROXY_LISTEN_PORT", Value: "8080", Source: "flag"}}
+	handler := NewAdminHandler(proxy.NewMetrics(), settings, func() []proxy.KeyInfo { return proxy.KeyInventory(testKeys) }, true)
+
+	tests := []struct {
+		path               string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{path: "/", expectedStatusCode: http.StatusOK, expectedBody: "/metrics"},
+		{path: "/metrics", expectedStatusCode: http.StatusOK, expectedBody: "jwtproxy_requests_in_flight"},
+		{path: "/debug/pprof/", expectedStatusCode: http.StatusOK, expectedBody: "goroutine"},
+		{path: "/config", expectedStatusCode: http.StatusOK, expectedBody: `"source": "flag"`},
+		{path: "/keys", expectedStatusCode: http.StatusOK, expectedBody: `"issuer": "example.com"`},
+		{path: "/build", expectedStatusCode: http.StatusOK, expectedBody: `"goVersion"`},
+		{path: "/unknown", expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %d, but got %d", test.path, test.expectedStatusCode, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body to contain '%s', but got '%s'", test.path, test.expectedBody, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	withoutPprof := NewAdminHandler(proxy.NewMetrics(), settings, func() []proxy.KeyInfo { return nil }, false)
+	withoutPprof.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected pprof not to be served unless enabled, but got status code %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/build", nil))
+	var build BuildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &build); err != nil {
+		t.Fatalf("failed to parse build info: %v", err)
+	}
+	if build.Version == "" {
+		t.Error("expected the build info to include a version")
+	}
+}
+
+func TestGetAdminServer(t *testing.T) {
+	tests := []struct {
+		name           string
+		env            map[string]string
+		expectedServer bool
+		expectedError  string
+	}{
+		{
+			name: "disabled by default",
+		},
+		{
+			name:           "enabled",
+			env:            map[string]string{"JWTPROXY_ADMIN_ADDRESS": "127.0.0.1:9091", "JWTPROXY_ADMIN_PPROF": "true"},
+			expectedServer: true,
+		},
+		{
+			name:          "invalid pprof setting",
+			env:           map[string]string{"JWTPROXY_ADMIN_ADDRESS": "127.0.0.1:9091", "JWTPROXY_ADMIN_PPROF": "yes please"},
+			expectedError: "JWTPROXY_ADMIN_PPROF",
+		},
+	}
+
+	defer func(s *settingSources) { settings = s }(settings)
+	for _, test := range tests {
+		env := test.env
+		settings = &settingSources{flags: flag.NewFlagSet("jwtproxy", flag.ContinueOnError), getenv: func(name string) string { return env[name] }}
+		flag.CommandLine.VisitAll(func(f *flag.Flag) {
+			settings.flags.String(f.Name, f.DefValue, f.Usage)
+		})
+
+		server, err := getAdminServer(proxy.NewMetrics(), proxy.NewKeyStore(testKeys))
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error containing '%s', but got %v", test.name, test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if (server != nil) != test.expectedServer {
+			t.Errorf("%s: expected server %v, but got %v", test.name, test.expectedServer, server != nil)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/a-h/jwtproxy/proxy"
+)
+
+// minAuditKeyLength is the minimum length of the audit log key, so that it can't be guessed.
+const minAuditKeyLength = 32
+
+func auditCommand(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	keyFile := fs.String("key", settings.getString("auditKey"), "The location of the file containing the key the audit log was written with.")
+	expect := fs.String("expect", "", "The hash of an entry which must be in the log, e.g. the last hash printed by an earlier verification.")
+	if len(args) == 0 || args[0] != "verify" || fs.Parse(args[1:]) != nil || fs.NArg() != 1 {
+		fmt.Fprintln(stdout, "usage: jwtproxy audit verify [-key audit.key] [-expect <hash>] <audit log file>")
+		return 2
+	}
+	path := fs.Arg(0)
+	key, err := readAuditKey(*keyFile)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to open file %s with error %v\n", path, err)
+		return 1
+	}
+	defer f.Close()
+	entries, lastHash, err := proxy.VerifyAuditLog(f, proxy.AuditVerifyOptions{Key: key, Expect: *expect})
+	if err != nil {
+		fmt.Fprintf(stdout, "FAIL: %v (%d entries verified)\n", err, entries)
+		return 1
+	}
+	fmt.Fprintf(stdout, "OK: %d entries verified, last hash %s\n", entries, lastHash)
+	if key == nil {
+		fmt.Fprintln(stdout, "WARNING: the log isn't keyed, so anyone who can write to it can recalculate the chain")
+	}
+	return 0
+}
+
+// readAuditKey reads the key used to chain audit log entries. If path is empty, the log isn't keyed.
+func readAuditKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read file %s with error %v", path, err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) < minAuditKeyLength {
+		return nil, fmt.Errorf("audit key %s must be at least %d bytes", path, minAuditKeyLength)
+	}
+	return key, nil
+}
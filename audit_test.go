@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-h/jwtproxy/proxy"
+)
+
+func TestAuditCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	record := func(key []byte) []byte {
+		var log bytes.Buffer
+		audit := proxy.NewAuditLog(&log, "", key)
+		for _, subject := range []string{"user-1", "user-2"} {
+			if err := audit.Record(proxy.AuditEntry{Time: time.Now(), Subject: subject, Outcome: "denied"}); err != nil {
+				t.Fatalf("failed to record entry: %v", err)
+			}
+		}
+		return log.Bytes()
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	log, keyedLog := record(nil), record(key)
+	valid := write("valid.log", log)
+	modified := write("modified.log", bytes.Replace(log, []byte("user-2"), []byte("user-3"), 1))
+	lines := bytes.SplitAfter(log, []byte("\n"))
+	truncated := write("truncated.log", lines[0])
+	var last proxy.AuditEntry
+	if err := json.Unmarshal(lines[1], &last); err != nil {
+		t.Fatal(err)
+	}
+	keyed := write("keyed.log", keyedLog)
+	keyFile := write("audit.key", append(key, '\n'))
+	shortKeyFile := write("short.key", []byte("secret"))
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectedCode   int
+		expectedOutput string
+	}{
+		{
+			name:           "valid",
+			args:           []string{"verify", valid},
+			expectedCode:   0,
+			expectedOutput: "OK: 2 entries verified",
+		},
+		{
+			name:           "valid and contains the expected entry",
+			args:           []string{"verify", "-expect", last.Hash, valid},
+			expectedCode:   0,
+			expectedOutput: "OK: 2 entries verified, last hash " + last.Hash,
+		},
+		{
+			name:           "truncated",
+			args:           []string{"verify", "-expect", last.Hash, truncated},
+			expectedCode:   1,
+			expectedOutput: "FAIL: expected entry " + last.Hash + " not found, entries may have been removed from the end of the log (1 entries verified)",
+		},
+		{
+			name:           "keyed",
+			args:           []string{"verify", "-key", keyFile, keyed},
+			expectedCode:   0,
+			expectedOutput: "OK: 2 entries verified",
+		},
+		{
+			name:           "keyed log verified without the key",
+			args:           []string{"verify", keyed},
+			expectedCode:   1,
+			expectedOutput: "FAIL: line 1: hash does not match the entry",
+		},
+		{
+			name:           "unkeyed log verified with a key",
+			args:           []string{"verify", "-key", keyFile, valid},
+			expectedCode:   1,
+			expectedOutput: "FAIL: line 1: hash does not match the entry",
+		},
+		{
+			name:           "short key",
+			args:           []string{"verify", "-key", shortKeyFile, keyed},
+			expectedCode:   1,
+			expectedOutput: "must be at least 32 bytes",
+		},
+		{
+			name:           "modified",
+			args:           []string{"verify", modified},
+			expectedCode:   1,
+			expectedOutput: "FAIL: line 2: hash does not match the entry, the entry has been modified (1 entries verified)",
+		},
+		{
+			name:           "missing file",
+			args:           []string{"verify", filepath.Join(dir, "missing.log")},
+			expectedCode:   1,
+			expectedOutput: "Failed to open file",
+		},
+		{
+			name:           "usage",
+			args:           []string{"check"},
+			expectedCode:   2,
+			expectedOutput: "usage: jwtproxy audit verify",
+		},
+	}
+
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		if code := auditCommand(test.args, &stdout); code != test.expectedCode {
+			t.Errorf("%s: expected exit code %d, but got %d: %s", test.name, test.expectedCode, code, stdout.String())
+		}
+		if !strings.Contains(stdout.String(), test.expectedOutput) {
+			t.Errorf("%s: expected output to contain '%s', but got '%s'", test.name, test.expectedOutput, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/a-h/jwtproxy/proxy"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// keygenCommand generates a key pair for an issuer. The private key is written to a file, and the public
+// key is printed in the formats accepted by the proxy.
+func keygenCommand(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	keyType := fs.String("type", "rsa", "The type of key to generate: 'rsa', 'ec' or 'ed25519'.")
+	bits := fs.Int("bits", 2048, "The size of RSA keys.")
+	curve := fs.String("curve", "P-256", "The curve of EC keys: 'P-256', 'P-384' or 'P-521'.")
+	out := fs.String("out", "private.pem", "The location to write the PEM encoded private key to. Existing files are not overwritten.")
+	issuer := fs.String("issuer", "example.com", "The issuer to use in the example keys.json.")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		fmt.Fprintln(stdout, "usage: jwtproxy keygen [-type rsa|ec|ed25519] [-out private.pem] [-issuer example.com]")
+		return 2
+	}
+
+	key, err := generateKey(*keyType, *bits, *curve)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to encode private key with error %v\n", err)
+		return 1
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to create file %s with error %v\n", *out, err)
+		return 1
+	}
+	err = pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to write file %s with error %v\n", *out, err)
+		return 1
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to encode public key with error %v\n", err)
+		return 1
+	}
+	pub := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	jwk, err := proxy.NewJSONWebKey(key.Public())
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to create JWK with error %v\n", err)
+		return 1
+	}
+	jwkJSON, _ := json.Marshal(jwk)
+	keysJSON, _ := json.MarshalIndent(map[string]string{*issuer: pub}, "", "  ")
+
+	fmt.Fprintf(stdout, "Wrote the private key to %s. Keep it secret, it's used to sign tokens.\n\n", *out)
+	fmt.Fprintf(stdout, "Public key (PEM):\n%s\n", pub)
+	fmt.Fprintf(stdout, "Public key (JWK):\n%s\n\n", jwkJSON)
+	fmt.Fprintf(stdout, "keys.json:\n%s\n", keysJSON)
+	return 0
+}
+
+func generateKey(keyType string, bits int, curve string) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case "rsa":
+		if bits < 2048 {
+			return nil, fmt.Errorf("invalid RSA key size %d, expected at least 2048 bits", bits)
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ec":
+		var c elliptic.Curve
+		switch curve {
+		case "P-256":
+			c = elliptic.P256()
+		case "P-384":
+			c = elliptic.P384()
+		case "P-521":
+			c = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("invalid curve '%s', expected 'P-256', 'P-384' or 'P-521'", curve)
+		}
+		return ecdsa.GenerateKey(c, rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("invalid key type '%s', expected 'rsa', 'ec' or 'ed25519'", keyType)
+}
+
+// parsePrivateKey parses a PEM encoded PKCS #8, PKCS #1 or SEC 1 private key.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("key is not PEM encoded")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// claimFlags collects repeated -claim name=value flags. Values which are valid JSON, e.g. numbers, are
+// added as JSON, and other values are added as strings.
+type claimFlags map[string]interface{}
+
+func (c claimFlags) String() string {
+	return ""
+}
+
+func (c claimFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid claim '%s', expected name=value", value)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(parts[1]), &v); err != nil {
+		v = parts[1]
+	}
+	c[parts[0]] = v
+	return nil
+}
+
+// signCommand signs a token using a private key, e.g. one created by keygenCommand, to test the proxy.
+func signCommand(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	keyFile := fs.String("key", "", "The location of the PEM encoded private key to sign the token with.")
+	iss := fs.String("iss", "", "The issuer of the token.")
+	exp := fs.Duration("exp", time.Hour, "How long the token is valid for.")
+	alg := fs.String("alg", "", "The signing algorithm. Defaults to RS256, ES256, ES384, ES512 or EdDSA depending on the key.")
+	kid := fs.String("kid", "", "The key ID to add to the token header.")
+	claimsJSON := fs.String("claims", "", "A JSON object of additional claims, e.g. '{\"scope\": \"read\"}'.")
+	claims := claimFlags{}
+	fs.Var(claims, "claim", "An additional claim, e.g. sub=partner. Can be repeated.")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *keyFile == "" || *iss == "" {
+		fmt.Fprintln(stdout, "usage: jwtproxy sign -key private.pem -iss example.com [-exp 1h] [-claim name=value]...")
+		return 2
+	}
+	if *exp <= 0 {
+		// The proxy rejects tokens which don't expire.
+		fmt.Fprintf(stdout, "invalid expiry %v, expected a duration greater than 0\n", *exp)
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to read file %s with error %v\n", *keyFile, err)
+		return 1
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to parse private key %s with error %v\n", *keyFile, err)
+		return 1
+	}
+	if *alg == "" {
+		_, algorithms, err := proxy.KeyAlgorithms(key.Public())
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			return 1
+		}
+		*alg = algorithms[0]
+	}
+	method := jwt.GetSigningMethod(*alg)
+	if method == nil {
+		fmt.Fprintf(stdout, "unknown signing method '%s'\n", *alg)
+		return 1
+	}
+	if err := proxy.VerifySigningMethod(method, key.Public()); err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+
+	now := time.Now()
+	mc := jwt.MapClaims{"iss": *iss, "iat": now.Unix(), "exp": now.Add(*exp).Unix()}
+	if *claimsJSON != "" {
+		var extra map[string]interface{}
+		if err := json.Unmarshal([]byte(*claimsJSON), &extra); err != nil {
+			fmt.Fprintf(stdout, "Failed to parse claims with error %v\n", err)
+			return 1
+		}
+		for k, v := range extra {
+			mc[k] = v
+		}
+	}
+	for k, v := range claims {
+		mc[k] = v
+	}
+
+	token := jwt.NewWithClaims(method, mc)
+	if *kid != "" {
+		token.Header["kid"] = *kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to sign token with error %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, signed)
+	return 0
+}
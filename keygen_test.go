@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/a-h/jwtproxy/proxy"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestKeygenAndSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name        string
+		args        []string
+		expectedAlg string
+	}{
+		{name: "rsa", args: []string{"-type", "rsa"}, expectedAlg: "RS256"},
+		{name: "ec", args: []string{"-type", "ec", "-curve", "P-384"}, expectedAlg: "ES384"},
+		{name: "ed25519", args: []string{"-type", "ed25519"}, expectedAlg: "EdDSA"},
+	}
+
+	for _, test := range tests {
+		privateKey := filepath.Join(dir, test.name+".pem")
+		var stdout bytes.Buffer
+		if code := keygenCommand(append(test.args, "-out", privateKey), &stdout); code != 0 {
+			t.Errorf("%s: expected keygen to succeed, but got %d: %s", test.name, code, stdout.String())
+			continue
+		}
+		block, _ := pem.Decode(stdout.Bytes())
+		if block == nil || block.Type != "PUBLIC KEY" {
+			t.Errorf("%s: expected a PEM encoded public key, but got %s", test.name, stdout.String())
+			continue
+		}
+		pub := string(pem.EncodeToMemory(block))
+		var jwk string
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if strings.HasPrefix(line, "{\"") {
+				jwk = line
+			}
+		}
+		if proxy.NormalizePublicKey(jwk) != pub {
+			t.Errorf("%s: expected the JWK %s to match the public key %s", test.name, jwk, pub)
+		}
+
+		stdout.Reset()
+		if code := signCommand([]string{"-key", privateKey, "-iss", "example.com", "-claim", "sub=partner", "-claim", "n=1"}, &stdout); code != 0 {
+			t.Errorf("%s: expected sign to succeed, but got %d: %s", test.name, code, stdout.String())
+			continue
+		}
+		token := strings.TrimSpace(stdout.String())
+		parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+		if err != nil || parsed.Method.Alg() != test.expectedAlg {
+			t.Errorf("%s: expected a token signed with %s, but got %v", test.name, test.expectedAlg, token)
+			continue
+		}
+		if claims := parsed.Claims.(jwt.MapClaims); claims["sub"] != "partner" || claims["n"] != 1.0 || claims["exp"] == nil {
+			t.Errorf("%s: unexpected claims %v", test.name, claims)
+		}
+
+		keys := proxy.NewKeyStore(map[string]string{"example.com": pub})
+		handler := proxy.NewJWTAuthHandler(proxy.JWTAuthOptions{Keys: keys}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected the token to be accepted, but got %d: %s", test.name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		expectedCode   int
+		expectedOutput string
+	}{
+		{
+			name:           "missing issuer",
+			args:           []string{"-key", "example_private.pem"},
+			expectedCode:   2,
+			expectedOutput: "usage: jwtproxy sign",
+		},
+		{
+			name:           "algorithm doesn't match the key",
+			args:           []string{"-key", "example_private.pem", "-iss", "example.com", "-alg", "ES256"},
+			expectedCode:   1,
+			expectedOutput: "Expected RS256, RS384, RS512, PS256, PS384, PS512 signing method but token specified ES256",
+		},
+		{
+			name:           "token which doesn't expire",
+			args:           []string{"-key", "example_private.pem", "-iss", "example.com", "-exp", "0"},
+			expectedCode:   2,
+			expectedOutput: "invalid expiry 0s, expected a duration greater than 0",
+		},
+		{
+			name:           "invalid claims",
+			args:           []string{"-key", "example_private.pem", "-iss", "example.com", "-claim", "sub"},
+			expectedCode:   2,
+			expectedOutput: "invalid claim 'sub'",
+		},
+	}
+
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		if code := signCommand(test.args, &stdout); code != test.expectedCode {
+			t.Errorf("%s: expected exit code %d, but got %d", test.name, test.expectedCode, code)
+		}
+		if !strings.Contains(stdout.String(), test.expectedOutput) {
+			t.Errorf("%s: expected output to contain '%s', but got '%s'", test.name, test.expectedOutput, stdout.String())
+		}
+	}
+}
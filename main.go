@@ -1,28 +1,105 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/a-h/jwtproxy/proxy"
 )
 
-var remoteURLFlag = flag.String("remoteURL", "", "The remote host to proxy to.")
-var remoteHostHeaderFlag = flag.String("remoteHostHeader", "", "The value of the 'Host' header to apply to outbound requests.")
-var keysFlag = flag.String("keys", "", "The location of the JSON map containing issuers and their public keys.")
-var portFlag = flag.String("port", "", "The port for the proxy to listen on.")
-var healthCheckFlag = flag.String("health", "/health", "The path to the healthcheck endpoint.")
-var prefixFlag = flag.String("prefix", "", "The prefix to strip from incoming requests applied to the remote URL, e.g to make /api/user?id=1 map to /user?id=1")
+// The flags can also be set using the environment variables in settingEnvironmentVariables, or in the
+// configuration file. Use the settings to read their values.
+func init() {
+	flag.String("config", "", "The location of a YAML or TOML configuration file. Command line flags and environment variables override its settings.")
+	flag.String("remoteURL", "", "The remote host to proxy to.")
+	flag.String("remoteHostHeader", "", "The value of the 'Host' header to apply to outbound requests.")
+	flag.String("remoteIssuerHeader", "", "The header used to pass the issuer of the caller's token to the remote host, e.g. X-Auth-Issuer. Not sent if not set.")
+	flag.String("remoteSubjectHeader", "", "The header used to pass the subject of the caller's token to the remote host, e.g. X-Auth-Subject. Not sent if not set.")
+	flag.String("remoteCA", "", "The location of a PEM encoded CA bundle to trust when connecting to the remote host, in addition to the system roots.")
+	flag.String("remoteCert", "", "The location of a PEM encoded client certificate to present to the remote host.")
+	flag.String("remoteKey", "", "The location of the PEM encoded private key matching the remoteCert.")
+	flag.String("remoteServerName", "", "The server name used for SNI and to verify the remote host's certificate. Defaults to the remoteHostHeader, if set.")
+	flag.Bool("remoteInsecureSkipVerify", false, "Disables verification of the remote host's certificate. Only use this in development.")
+	flag.Duration("remoteDialTimeout", 0, "The maximum time to wait to connect to the remote host, e.g. 5s. Defaults to 30s.")
+	flag.Duration("remoteTLSHandshakeTimeout", 0, "The maximum time to wait for a TLS handshake with the remote host. Defaults to 10s.")
+	flag.Duration("remoteResponseHeaderTimeout", 0, "The maximum time to wait for the remote host's response headers after sending the request. Defaults to no limit.")
+	flag.Duration("remoteIdleConnTimeout", 0, "The maximum time an idle connection to the remote host is kept open. Defaults to 90s.")
+	flag.Int("remoteMaxIdleConns", 0, "The maximum number of idle connections to the remote host. Defaults to 100.")
+	flag.Int("remoteMaxIdleConnsPerHost", 0, "The maximum number of idle connections to keep per remote host. Defaults to 2.")
+	flag.Int("remoteMaxConnsPerHost", 0, "The maximum number of connections per remote host, including those in use. Defaults to no limit.")
+	flag.Int("maxConnections", 0, "The maximum number of client connections open at once. Further connections wait to be accepted. Defaults to no limit.")
+	flag.Int("maxHeaderBytes", 0, "The maximum size of the headers of an incoming request, in bytes. Defaults to 1MB.")
+	flag.Int("maxBodyBytes", 0, "The maximum size of the body of an incoming request, in bytes. Larger requests are rejected with 413 Request Entity Too Large. Defaults to no limit.")
+	flag.Duration("readTimeout", 0, "The maximum time to read an entire incoming request, including the body. Defaults to no limit.")
+	flag.Duration("readHeaderTimeout", 10*time.Second, "The maximum time to read the headers of an incoming request.")
+	flag.Duration("writeTimeout", 0, "The maximum time to write a response, from the end of reading the request headers. Defaults to no limit.")
+	flag.Duration("idleTimeout", 120*time.Second, "The maximum time to keep an idle client connection open.")
+	flag.Duration("drainPeriod", 0, "How long to fail health checks for before shutting down after receiving SIGTERM or SIGINT, e.g. 10s.")
+	flag.Duration("shutdownTimeout", 30*time.Second, "The maximum time to wait for requests in progress to complete when shutting down.")
+	flag.String("logFormat", "", "The access log format: 'json' (default), 'logfmt', 'common', 'combined' or a Go template, e.g. '{{.Method}} {{.URL}} {{.Status}}'.")
+	flag.String("logHeaders", "", "A comma separated list of request headers to include in the access log.")
+	flag.String("logClaims", "", "A comma separated list of JWT claims to include in the access log.")
+	flag.String("logRedact", "", "A comma separated list of redactions applied to logged headers, claims and query string parameters, e.g. 'header:X-Api-Key=drop,claim:email=hash,query:api_key=mask'.")
+	flag.String("auditLog", "", "The location of a file to append a hash-chained audit log of authentication decisions to.")
+	flag.String("auditKey", "", "The location of a file containing a secret of at least 32 bytes, used to chain the audit log with HMACs so that it can't be rewritten without the key.")
+	flag.String("adminAddress", "", "The address for the admin server to listen on, e.g. localhost:9901, which serves metrics, the effective configuration, the key inventory and build information. Disabled if not set.")
+	flag.Bool("adminPprof", false, "Serve Go profiling data from the admin server at /debug/pprof/.")
+	flag.String("otlpEndpoint", "", "The URL of the OpenTelemetry collector to send traces to using OTLP/HTTP, e.g. http://localhost:4318. Tracing is disabled if not set.")
+	flag.Float64("otlpSampleRatio", 1, "The fraction of new traces to sample, from 0 to 1. Traces continued from a caller's traceparent header keep the caller's decision.")
+	flag.String("requestIDHeader", proxy.DefaultRequestIDHeader, "The header used to receive request IDs from callers, pass them to the remote host and return them in responses.")
+	flag.String("keys", "", "The location of the JSON map containing issuers and their public keys.")
+	flag.String("keysCA", "", "The location of a PEM encoded CA bundle used to verify issuer keys which are certificates.")
+	flag.String("keysCertExpiry", "reject", "What to do with tokens from issuers whose key is an expired certificate: 'reject' or 'warn'.")
+	flag.Duration("keysCertWarnBefore", 30*24*time.Hour, "How long before an issuer's certificate expires to start logging warnings.")
+	flag.String("jwksURLs", "", "A comma separated list of issuers and the URLs of their JSON Web Key Sets, e.g. 'example.com=https://example.com/.well-known/jwks.json'. Key sets are fetched when first used.")
+	flag.String("keysDir", "", "The location of a directory containing a public key file for each issuer, e.g. example.com.pem. Keys are reloaded on SIGHUP.")
+	flag.String("port", "", "The port for the proxy to listen on.")
+	flag.String("health", "/health", "The path to the healthcheck endpoint.")
+	flag.String("live", "", "The path to the liveness endpoint, which returns 200 while the process is running. Disabled if not set.")
+	flag.String("ready", "", "The path to the readiness endpoint, which returns 200 if keys are loaded, the remote host is reachable and the proxy isn't draining. Disabled if not set.")
+	flag.Bool("healthJSON", false, "Return a JSON body detailing each check from the health, liveness and readiness endpoints.")
+	flag.String("prefix", "", "The prefix to strip from incoming requests applied to the remote URL, e.g to make /api/user?id=1 map to /user?id=1")
+	flag.String("tlsCert", "", "The location of the PEM encoded certificate to serve TLS with. If not set, the proxy listens using plain HTTP.")
+	flag.String("tlsKey", "", "The location of the PEM encoded private key matching the tlsCert.")
+	flag.String("clientCA", "", "The location of the PEM encoded CA bundle used to verify client certificates.")
+	flag.String("clientAuth", "", "Whether to ask for client certificates: 'none' (default), 'request' (verify if given) or 'require'.")
+	flag.String("clientCerts", "", "The location of the JSON map containing client certificate subjects or subject alternative names and their issuers.")
+	flag.String("certBoundIssuers", "", "A comma separated list of issuers whose tokens must be bound to the client certificate using the cnf claim.")
+	flag.String("dpopIssuers", "", "A comma separated list of issuers whose tokens must be sent with a DPoP proof of possession.")
+	flag.String("trustedProxies", "", "A comma separated list of the IP addresses or CIDR ranges of load balancers which are trusted to set the X-Forwarded-Proto header, e.g. 10.0.0.0/8.")
+	flag.String("auth", "", "The authentication mode: 'jwt' (default), 'cert' (client certificate only) or 'both' (client certificate and JWT).")
+}
+
+// settings are the command line flags, environment variables and configuration file of the process.
+var settings = &settingSources{flags: flag.CommandLine, getenv: os.Getenv}
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:], os.Stdout))
+		}
+	}
+
 	flag.Parse()
+	if err := settings.loadFile(); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
 
 	remoteURL, err := getRemoteURL()
 	if err != nil {
@@ -30,11 +107,24 @@ func main() {
 		os.Exit(-1)
 	}
 
+	metrics := proxy.NewMetrics()
 	keys, err := getKeys(os.Environ())
+	metrics.KeysLoaded(err)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
+	store := proxy.NewKeyStore(keys)
+	if err := reportKeys(metrics, keys); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	jwksURLs, err := getJWKSURLs()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	keyProvider := newKeyProvider(store, jwksURLs)
 
 	port, err := getPort()
 	if err != nil {
@@ -43,80 +133,249 @@ func main() {
 	}
 
 	prefix := getPrefix()
+
+	remoteHostHeader := getRemoteHostHeader()
+
+	audit, err := getAuditLog()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
 
-	remoteHostHeader := getRemoteHostHeader()
+	authMode, err := getAuthMode()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	tlsConfig, err := getTLSConfig(authMode)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	identities, err := getClientCertificateIdentities(authMode)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	if _, err := getTrustedProxies(); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
 
-	proxy := NewReverseProxy(remoteURL, remoteHostHeader)
+	upstreamOptions, err := getUpstreamOptions(remoteHostHeader)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	if upstreamOptions.InsecureSkipVerify {
+		fmt.Println("WARNING: verification of the remote host's TLS certificate is disabled, do not use this in production")
+	}
+
+	transport, err := proxy.NewUpstreamTransport(upstreamOptions)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	tracing, err := getTracing()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	reverseProxyOptions := proxy.ReverseProxyOptions{
+		Target:        remoteURL,
+		HostHeader:    remoteHostHeader,
+		Transport:     transport,
+		IssuerHeader:  settings.getString("remoteIssuerHeader"),
+		SubjectHeader: settings.getString("remoteSubjectHeader"),
+	}
+	if tracing != nil {
+		reverseProxyOptions.Transport = tracing.Transport(transport)
+	}
+	reverseProxy := proxy.NewReverseProxy(reverseProxyOptions)
+	maxBodyBytes, err := settings.getInt("maxBodyBytes")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
 
 	// A request comes in to a load balancer of https://example.com/api/user?id=1
 	// We've pointed it to the RemoteURL of https://api.example.org/
 	// And we want to get https://api.example.org/user?id=1
 	// The SingleHostReverseProxy doesn't strip the /api from the incoming request
 	// So without rewriting the request, we'd actually get a request to https://api.example.org/api/user?id=1
-	rewrite := NewRewriteHandler(prefix, proxy)
+	rewrite := proxy.NewRewriteHandler(prefix, proxy.NewBodyLimitHandler(int64(maxBodyBytes), reverseProxy))
 
 	// Wrap the proxy in authentication.
-	auth := NewJWTAuthHandler(keys, time.Now, rewrite)
+	jwtAuth, err := newJWTAuthHandler(keyProvider, audit, rewrite)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	var auth http.Handler
+	switch authMode {
+	case authModeJWT:
+		auth = jwtAuth
+	case authModeCert:
+		auth = proxy.NewClientCertAuthHandler(identities, rewrite)
+	case authModeBoth:
+		// The JWT's issuer must match the issuer mapped from the client certificate.
+		auth = proxy.NewClientCertAuthHandler(identities, jwtAuth)
+	}
 
 	// Wrap the authentication in a health check (health checks don't need authentication).
-	health := HealthCheckHandler{
-		Path: getHealthCheckURI(),
-		Next: auth,
+	shutdown := &proxy.ShutdownState{}
+	healthCheckJSON, err := settings.getBool("healthJSON")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	health := proxy.HealthCheckHandler{
+		Path:          getHealthCheckURI(),
+		LivenessPath:  getLivenessURI(),
+		ReadinessPath: getReadinessURI(),
+		Checks:        getReadinessChecks(authMode, store, jwksURLs, identities, remoteURL),
+		JSON:          healthCheckJSON,
+		Draining:      shutdown.Draining,
+		Next:          auth,
 	}
 
-	// Wrap the health check in a logger.
-	app := NewLoggingHandler(health)
+	logFormat, err := getLogFormat()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
 
-	http.ListenAndServe(":"+port, app)
-}
+	// Wrap the health check in tracing, metrics and a logger, and count requests in progress.
+	redactions, err := getLogRedactions()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	var traced http.Handler = health
+	if tracing != nil {
+		traced = tracing.Handler(health)
+	}
+
+	logger := proxy.NewLoggingHandler(proxy.NewMetricsHandler(metrics, traced))
+	logger.Format = logFormat
+	logger.Headers = getLogHeaders()
+	logger.Claims = getLogClaims()
+	logger.Redactions = redactions
+	app := shutdown.Track(proxy.NewRequestIDHandler(getRequestIDHeader(), logger))
 
-// NewReverseProxy creates a reverse proxy.
-func NewReverseProxy(target *url.URL, hostHeader string) *httputil.ReverseProxy {
-	targetQuery := target.RawQuery
-	director := func(req *http.Request) {
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
-		if targetQuery == "" || req.URL.RawQuery == "" {
-			req.URL.RawQuery = targetQuery + req.URL.RawQuery
-		} else {
-			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+	server, err := getServer(":"+port, app, tlsConfig)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	drainPeriod, err := settings.getDuration("drainPeriod")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	shutdownTimeout, err := settings.getDuration("shutdownTimeout")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	admin, err := getAdminServer(metrics, store)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	go reloadKeys(store, metrics)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	errs := make(chan error, 1)
+	go func() {
+		listener, err := listen(server.Addr)
+		if err != nil {
+			errs <- err
+			return
 		}
-		if _, ok := req.Header["User-Agent"]; !ok {
-			// explicitly disable User-Agent so it's not set to default value
-			req.Header.Set("User-Agent", "")
+		if tlsConfig != nil {
+			// The certificate is loaded into the TLS configuration.
+			errs <- server.ServeTLS(listener, "", "")
+			return
 		}
-		// Override the host header.
-		if hostHeader == "" {
-			req.Host = target.Host
-		} else {
-			req.Host = hostHeader
+		errs <- server.Serve(listener)
+	}()
+	if admin != nil {
+		// The proxy doesn't depend on the admin server, so keep proxying if it fails.
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Printf("WARNING: the admin server failed with error %v, continuing without it\n", err)
+			}
+		}()
+	}
+
+	select {
+	case err = <-errs:
+		fmt.Println(err)
+		os.Exit(-1)
+	case sig := <-signals:
+		fmt.Printf("received %v\n", sig)
+		// Keep serving metrics while draining.
+		err = shutdown.Shutdown(server, drainPeriod, shutdownTimeout, os.Stdout)
+		if admin != nil {
+			admin.Close()
+		}
+		if tracing != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := tracing.Shutdown(ctx); err != nil {
+				fmt.Println(err)
+			}
+			cancel()
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
 		}
 	}
-	return &httputil.ReverseProxy{Director: director}
 }
 
-func singleJoiningSlash(a, b string) string {
-	aslash := strings.HasSuffix(a, "/")
-	bslash := strings.HasPrefix(b, "/")
-	switch {
-	case aslash && bslash:
-		return a + b[1:]
-	case !aslash && !bslash:
-		return a + "/" + b
+// commands are run by passing their name as the first argument, e.g. "jwtproxy audit verify audit.log".
+var commands = map[string]func(args []string, stdout io.Writer) int{
+	"audit":           auditCommand,
+	"keygen":          keygenCommand,
+	"sign":            signCommand,
+	"validate-config": validateConfigCommand,
+	"verify":          verifyCommand,
+}
+
+func newJWTAuthHandler(keys proxy.KeyProvider, audit *proxy.AuditLog, next http.Handler) (proxy.JWTAuthHandler, error) {
+	allowExpiredCertificates, err := getAllowExpiredCertificates()
+	if err != nil {
+		return proxy.JWTAuthHandler{}, err
 	}
-	return a + b
+	trustedProxies, err := getTrustedProxies()
+	if err != nil {
+		return proxy.JWTAuthHandler{}, err
+	}
+	h := proxy.NewJWTAuthHandler(proxy.JWTAuthOptions{
+		Keys:                     keys,
+		CertificateBoundIssuers:  getCertificateBoundIssuers(),
+		DPoPIssuers:              getDPoPIssuers(),
+		TrustedProxies:           trustedProxies,
+		AllowExpiredCertificates: allowExpiredCertificates,
+		Audit:                    audit,
+	}, next)
+	return h, nil
 }
 
 func getPort() (string, error) {
-	port := *portFlag
-	if port == "" {
-		port = os.Getenv("JWTPROXY_LISTEN_PORT")
-	}
+	port := settings.getString("port")
 	if port == "" {
 		return "9090", errors.New("JWTPROXY_LISTEN_PORT environment variable or port command line flag not found")
 	}
@@ -124,10 +383,7 @@ func getPort() (string, error) {
 }
 
 func getRemoteURL() (*url.URL, error) {
-	remoteURL := *remoteURLFlag
-	if remoteURL == "" {
-		remoteURL = os.Getenv("JWTPROXY_REMOTE_URL")
-	}
+	remoteURL := settings.getString("remoteURL")
 	if remoteURL == "" {
 		return nil, errors.New("JWTPROXY_REMOTE_URL environment variable or remoteURL command line flag not found")
 	}
@@ -139,10 +395,26 @@ func getRemoteURL() (*url.URL, error) {
 }
 
 func getKeys(environ []string) (map[string]string, error) {
-	keys, err := getKeysFromEnvironment(environ)
+	// Keys in the configuration file are overridden by the keys directory, then the environment, then the
+	// keys file. Unlike other settings, the sources are merged, so the order is documented in the README.
+	keys, err := settings.fileKeys()
 	if err != nil {
 		return keys, err
 	}
+	fromDirectory, err := getKeysFromDirectory()
+	if err != nil {
+		return fromDirectory, err
+	}
+	for k, v := range fromDirectory {
+		keys[k] = v
+	}
+	fromEnv, err := getKeysFromEnvironment(environ)
+	if err != nil {
+		return fromEnv, err
+	}
+	for k, v := range fromEnv {
+		keys[k] = v
+	}
 	fromConfig, err := getKeysFromConfigFile()
 	if err != nil {
 		return fromConfig, err
@@ -150,29 +422,140 @@ func getKeys(environ []string) (map[string]string, error) {
 	for k, v := range fromConfig {
 		keys[k] = v
 	}
-	return keys, nil
+	roots, err := getKeysCA()
+	if err != nil {
+		return keys, err
+	}
+	return keys, proxy.VerifyIssuerCertificates(keys, roots, time.Now())
+}
+
+// newKeyProvider combines the keys in the store with the key sets of the issuers in jwksURLs. Keys in the
+// store take precedence.
+func newKeyProvider(store *proxy.KeyStore, jwksURLs map[string]string) proxy.KeyProvider {
+	if len(jwksURLs) == 0 {
+		return store
+	}
+	return proxy.KeyProviders{store, proxy.NewJWKSKeyProvider(proxy.JWKSOptions{URLs: jwksURLs})}
+}
+
+// getJWKSURLs parses the jwksURLs setting, which maps issuers to the URLs of their JSON Web Key Sets.
+func getJWKSURLs() (map[string]string, error) {
+	urls := make(map[string]string)
+	for _, v := range splitList(settings.getString("jwksURLs")) {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid JWKS URL '%s', expected issuer=url", v)
+		}
+		u, err := url.Parse(parts[1])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid JWKS URL '%s' for issuer '%s', expected an absolute http or https URL", parts[1], parts[0])
+		}
+		urls[parts[0]] = parts[1]
+	}
+	return urls, nil
+}
+
+func getKeysCA() (*x509.CertPool, error) {
+	path := settings.getString("keysCA")
+	if path == "" {
+		return nil, nil
+	}
+	return readCertPool(path)
+}
+
+func getAllowExpiredCertificates() (bool, error) {
+	switch v := settings.getString("keysCertExpiry"); v {
+	case "reject":
+		return false, nil
+	case "warn":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid certificate expiry '%s', expected one of 'reject' or 'warn'", v)
+	}
+}
+
+// reportKeys warns about issuer certificates which have expired or will expire soon.
+func reportKeys(metrics *proxy.Metrics, keys map[string]string) error {
+	allowExpired, err := getAllowExpiredCertificates()
+	if err != nil {
+		return err
+	}
+	warnBefore, err := settings.getDuration("keysCertWarnBefore")
+	if err != nil {
+		return err
+	}
+	proxy.ReportIssuerCertificates(os.Stdout, metrics, keys, time.Now(), warnBefore, allowExpired)
+	return nil
+}
+
+// reloadKeys replaces the keys in the store when the process receives SIGHUP. If the keys can't be
+// loaded, the previous keys are kept.
+func reloadKeys(store *proxy.KeyStore, metrics *proxy.Metrics) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		keys, err := getKeys(os.Environ())
+		metrics.KeysLoaded(err)
+		if err != nil {
+			fmt.Printf("failed to reload keys, the previous keys are still in use: %v\n", err)
+			continue
+		}
+		store.Set(keys)
+		fmt.Printf("reloaded the keys of %d issuer(s)\n", len(keys))
+		if err := reportKeys(metrics, keys); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func getKeysFromDirectory() (map[string]string, error) {
+	dir := settings.getString("keysDir")
+	if dir == "" {
+		return make(map[string]string), nil
+	}
+	return proxy.ReadKeysDirectory(dir)
 }
 
 func getKeysFromEnvironment(environ []string) (map[string]string, error) {
 	issuerPrefix := "JWTPROXY_ISSUER_"
 	keyPrefix := "JWTPROXY_PUBLIC_KEY_"
+	keyFilePrefix := "JWTPROXY_PUBLIC_KEY_FILE_"
 
 	suffixToIssuerMap := make(map[string]string)
 	suffixToKeyMap := make(map[string]string)
+	suffixToKeyFileMap := make(map[string]string)
 
 	for _, s := range environ {
-		parts := strings.Split(s, "=")
-		envName := parts[0]
-		if strings.HasPrefix(envName, issuerPrefix) {
-			suffix := envName[len(issuerPrefix):]
-			suffixToIssuerMap[suffix] = parts[1]
+		// Values may contain '=', e.g. base64 padding.
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 {
+			continue
 		}
-		if strings.HasPrefix(envName, keyPrefix) {
-			suffix := envName[len(keyPrefix):]
-			suffixToKeyMap[suffix] = parts[1]
+		envName, value := parts[0], parts[1]
+		switch {
+		case strings.HasPrefix(envName, issuerPrefix):
+			suffixToIssuerMap[envName[len(issuerPrefix):]] = value
+		case strings.HasPrefix(envName, keyFilePrefix):
+			suffixToKeyFileMap[envName[len(keyFilePrefix):]] = value
+		case strings.HasPrefix(envName, keyPrefix):
+			suffixToKeyMap[envName[len(keyPrefix):]] = value
 		}
 	}
 
+	for suffix, path := range suffixToKeyFileMap {
+		if _, ok := suffixToKeyMap[suffix]; ok {
+			return make(map[string]string), fmt.Errorf("only one of JWTPROXY_PUBLIC_KEY_%s or JWTPROXY_PUBLIC_KEY_FILE_%s can be set", suffix, suffix)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return make(map[string]string), fmt.Errorf("Failed to read file %s with error %v", path, err)
+		}
+		suffixToKeyMap[suffix] = string(data)
+	}
+	for suffix, key := range suffixToKeyMap {
+		suffixToKeyMap[suffix] = proxy.NormalizePublicKey(key)
+	}
+
 	return zip(suffixToIssuerMap, suffixToKeyMap)
 }
 
@@ -182,7 +565,7 @@ func zip(keys, values map[string]string) (map[string]string, error) {
 	for suffix, issuer := range keys {
 		value, ok := values[suffix]
 		if !ok {
-			return m, fmt.Errorf("could not find a matching JWTPROXY_PUBLIC_KEY_%s value for JWTPROXY_ISSUER_%s", suffix, suffix)
+			return m, fmt.Errorf("could not find a matching JWTPROXY_PUBLIC_KEY_%s or JWTPROXY_PUBLIC_KEY_FILE_%s value for JWTPROXY_ISSUER_%s", suffix, suffix, suffix)
 		}
 		m[issuer] = value
 	}
@@ -191,50 +574,402 @@ func zip(keys, values map[string]string) (map[string]string, error) {
 }
 
 func getKeysFromConfigFile() (map[string]string, error) {
-	keys := make(map[string]string)
-	configPath := os.Getenv("JWTPROXY_CONFIG")
+	configPath := settings.getString("keys")
 	if configPath == "" {
-		configPath = *keysFlag
+		return make(map[string]string), nil
 	}
-	if configPath == "" {
-		return keys, nil
-	}
-	file, err := os.Open(configPath)
-	defer file.Close()
+	return proxy.ReadKeysFile(configPath)
+}
+
+func readJSONMap(path string) (map[string]string, error) {
+	m := make(map[string]string)
+	file, err := os.Open(path)
 	if err != nil {
-		return keys, fmt.Errorf("Failed to open file %s with error %v", configPath, err)
+		return m, fmt.Errorf("Failed to open file %s with error %v", path, err)
 	}
+	defer file.Close()
 	data, err := ioutil.ReadAll(file)
 	if err != nil {
-		return keys, fmt.Errorf("Failed to read file %s with error %v", configPath, err)
+		return m, fmt.Errorf("Failed to read file %s with error %v", path, err)
 	}
-	err = json.Unmarshal(data, &keys)
+	err = json.Unmarshal(data, &m)
 	if err != nil {
-		return keys, fmt.Errorf("Failed to parse JSON file %s with error %v", configPath, err)
+		return m, fmt.Errorf("Failed to parse JSON file %s with error %v", path, err)
 	}
-	return keys, nil
+	return m, nil
 }
 
 func getHealthCheckURI() string {
-	hc := os.Getenv("JWTPROXY_HEALTHCHECK_URI")
-	if hc == "" {
-		return *healthCheckFlag
+	return settings.getString("health")
+}
+
+func getLivenessURI() string {
+	p := settings.getString("live")
+	return p
+}
+
+func getReadinessURI() string {
+	p := settings.getString("ready")
+	return p
+}
+
+func getReadinessChecks(authMode string, keys *proxy.KeyStore, jwksURLs, identities map[string]string, remoteURL *url.URL) []proxy.HealthCheck {
+	checks := []proxy.HealthCheck{}
+	if authMode != authModeCert && len(jwksURLs) == 0 {
+		checks = append(checks, proxy.HealthCheck{Name: "keys", Check: func() error {
+			return notEmpty(keys.Keys(), "no issuer keys are loaded")()
+		}})
 	}
-	return hc
+	if authMode != authModeJWT {
+		checks = append(checks, proxy.HealthCheck{Name: "clientCerts", Check: notEmpty(identities, "no client certificate identities are loaded")})
+	}
+	return append(checks, proxy.HealthCheck{Name: "upstream", Check: proxy.UpstreamReachable(remoteURL, time.Second)})
 }
 
-func getPrefix() string {
-	prefix := *prefixFlag
-	if prefix == "" {
-		prefix = os.Getenv("JWTPROXY_PREFIX")
+func notEmpty(m map[string]string, msg string) func() error {
+	return func() error {
+		if len(m) == 0 {
+			return errors.New(msg)
+		}
+		return nil
+	}
+}
+
+func getLogFormat() (proxy.LogFormatter, error) {
+	format := settings.getString("logFormat")
+	return proxy.NewLogFormatter(format)
+}
+
+func getLogHeaders() []string {
+	headers := settings.getString("logHeaders")
+	return splitList(headers)
+}
+
+func getLogClaims() []string {
+	claims := settings.getString("logClaims")
+	return splitList(claims)
+}
+
+func getLogRedactions() (proxy.RedactionRules, error) {
+	rules := settings.getString("logRedact")
+	return proxy.ParseRedactionRules(rules)
+}
+
+func getAuditLog() (*proxy.AuditLog, error) {
+	path := settings.getString("auditLog")
+	if path == "" {
+		return nil, nil
 	}
+	key, err := readAuditKey(settings.getString("auditKey"))
+	if err != nil {
+		return nil, err
+	}
+	return proxy.OpenAuditLog(path, key)
+}
+
+func getPrefix() string {
+	prefix := settings.getString("prefix")
 	return prefix
 }
 
 func getRemoteHostHeader() string {
-	h := *remoteHostHeaderFlag
-	if h == "" {
-		h = os.Getenv("JWTPROXY_REMOTE_HOST_HEADER")
-	}
+	h := settings.getString("remoteHostHeader")
 	return h
 }
+
+func getUpstreamOptions(remoteHostHeader string) (proxy.UpstreamOptions, error) {
+	o := proxy.UpstreamOptions{
+		CAFile:     settings.getString("remoteCA"),
+		CertFile:   settings.getString("remoteCert"),
+		KeyFile:    settings.getString("remoteKey"),
+		ServerName: settings.getString("remoteServerName"),
+	}
+	// If the Host header is overridden, the remote's certificate is most likely issued for that host too.
+	if o.ServerName == "" && remoteHostHeader != "" {
+		o.ServerName = remoteHostHeader
+		if host, _, err := net.SplitHostPort(remoteHostHeader); err == nil {
+			o.ServerName = host
+		}
+	}
+	var err error
+	if o.InsecureSkipVerify, err = settings.getBool("remoteInsecureSkipVerify"); err != nil {
+		return o, err
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return o, errors.New("both of the JWTPROXY_REMOTE_CERT and JWTPROXY_REMOTE_KEY environment variables or remoteCert and remoteKey command line flags must be set")
+	}
+	if o.DialTimeout, err = settings.getDuration("remoteDialTimeout"); err != nil {
+		return o, err
+	}
+	if o.TLSHandshakeTimeout, err = settings.getDuration("remoteTLSHandshakeTimeout"); err != nil {
+		return o, err
+	}
+	if o.ResponseHeaderTimeout, err = settings.getDuration("remoteResponseHeaderTimeout"); err != nil {
+		return o, err
+	}
+	if o.IdleConnTimeout, err = settings.getDuration("remoteIdleConnTimeout"); err != nil {
+		return o, err
+	}
+	if o.MaxIdleConns, err = settings.getInt("remoteMaxIdleConns"); err != nil {
+		return o, err
+	}
+	if o.MaxIdleConnsPerHost, err = settings.getInt("remoteMaxIdleConnsPerHost"); err != nil {
+		return o, err
+	}
+	if o.MaxConnsPerHost, err = settings.getInt("remoteMaxConnsPerHost"); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// getTracing returns the tracing of requests, or nil if tracing is disabled.
+func getTracing() (*proxy.Tracing, error) {
+	endpoint := settings.getString("otlpEndpoint")
+	if endpoint == "" {
+		return nil, nil
+	}
+	sampleRatio, err := getOTLPSampleRatio()
+	if err != nil {
+		return nil, err
+	}
+	return proxy.NewTracing(proxy.TracingOptions{Endpoint: endpoint, SampleRatio: sampleRatio})
+}
+
+func getOTLPSampleRatio() (float64, error) {
+	ratio, err := settings.getFloat("otlpSampleRatio")
+	if err != nil {
+		return 0, err
+	}
+	if ratio < 0 || ratio > 1 {
+		return 0, fmt.Errorf("invalid OTLP sample ratio %v, expected a number from 0 to 1", ratio)
+	}
+	return ratio, nil
+}
+
+func getRequestIDHeader() string {
+	return settings.getString("requestIDHeader")
+}
+
+// getAdminServer returns the server for the admin endpoints, or nil if the admin server is disabled.
+func getAdminServer(metrics *proxy.Metrics, keys *proxy.KeyStore) (*http.Server, error) {
+	addr := settings.getString("adminAddress")
+	if addr == "" {
+		return nil, nil
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && !isLoopback(host) {
+		fmt.Printf("WARNING: the admin server exposes configuration details on %s, make sure it's not publicly accessible\n", addr)
+	}
+	servePprof, err := settings.getBool("adminPprof")
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:              addr,
+		Handler:           NewAdminHandler(metrics, settings.all(), func() []proxy.KeyInfo { return proxy.KeyInventory(keys.Keys()) }, servePprof),
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func getServer(addr string, handler http.Handler, tlsConfig *tls.Config) (*http.Server, error) {
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	var err error
+	if server.ReadTimeout, err = settings.getDuration("readTimeout"); err != nil {
+		return nil, err
+	}
+	if server.ReadHeaderTimeout, err = settings.getDuration("readHeaderTimeout"); err != nil {
+		return nil, err
+	}
+	if server.WriteTimeout, err = settings.getDuration("writeTimeout"); err != nil {
+		return nil, err
+	}
+	if server.IdleTimeout, err = settings.getDuration("idleTimeout"); err != nil {
+		return nil, err
+	}
+	if server.MaxHeaderBytes, err = settings.getInt("maxHeaderBytes"); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// listen opens the proxy's listener, limiting the number of open connections if maxConnections is set.
+func listen(addr string) (net.Listener, error) {
+	maxConnections, err := settings.getInt("maxConnections")
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if maxConnections > 0 {
+		listener = proxy.LimitListener(listener, maxConnections)
+	}
+	return listener, nil
+}
+
+const (
+	authModeJWT  = "jwt"
+	authModeCert = "cert"
+	authModeBoth = "both"
+)
+
+func getAuthMode() (string, error) {
+	mode := settings.getString("auth")
+	switch mode {
+	case "":
+		return authModeJWT, nil
+	case authModeJWT, authModeCert, authModeBoth:
+		return mode, nil
+	}
+	return authModeJWT, fmt.Errorf("invalid auth mode '%s', expected one of 'jwt', 'cert' or 'both'", mode)
+}
+
+func getTLSConfig(authMode string) (*tls.Config, error) {
+	cert := settings.getString("tlsCert")
+	key := settings.getString("tlsKey")
+	clientAuth, err := getClientAuth()
+	if err != nil {
+		return nil, err
+	}
+	if cert == "" && key == "" {
+		if authMode != authModeJWT || clientAuth != tls.NoClientCert {
+			return nil, errors.New("client certificate authentication requires the JWTPROXY_TLS_CERT and JWTPROXY_TLS_KEY environment variables or tlsCert and tlsKey command line flags")
+		}
+		return nil, nil
+	}
+	if cert == "" || key == "" {
+		return nil, errors.New("both of the JWTPROXY_TLS_CERT and JWTPROXY_TLS_KEY environment variables or tlsCert and tlsKey command line flags must be set")
+	}
+	if authMode != authModeJWT && clientAuth == tls.NoClientCert {
+		return nil, fmt.Errorf("auth mode '%s' requires JWTPROXY_CLIENT_AUTH or the clientAuth command line flag to be 'request' or 'require'", authMode)
+	}
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate %s and key %s with error %v", cert, key, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   clientAuth,
+	}
+	if clientAuth != tls.NoClientCert {
+		config.ClientCAs, err = getClientCAs()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func getClientAuth() (tls.ClientAuthType, error) {
+	clientAuth := settings.getString("clientAuth")
+	switch clientAuth {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("invalid client auth '%s', expected one of 'none', 'request' or 'require'", clientAuth)
+}
+
+func getClientCAs() (*x509.CertPool, error) {
+	path := settings.getString("clientCA")
+	if path == "" {
+		return nil, errors.New("JWTPROXY_CLIENT_CA environment variable or clientCA command line flag not found")
+	}
+	return readCertPool(path)
+}
+
+// readCertPool reads a PEM encoded CA bundle.
+func readCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read file %s with error %v", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+func getClientCertificateIdentities(authMode string) (map[string]string, error) {
+	path := settings.getString("clientCerts")
+	if path == "" {
+		if authMode == authModeJWT {
+			return make(map[string]string), nil
+		}
+		return nil, errors.New("JWTPROXY_CLIENT_CERTS environment variable or clientCerts command line flag not found")
+	}
+	return readJSONMap(path)
+}
+
+func getCertificateBoundIssuers() map[string]bool {
+	issuers := settings.getString("certBoundIssuers")
+	return splitSet(issuers)
+}
+
+func getDPoPIssuers() map[string]bool {
+	issuers := settings.getString("dpopIssuers")
+	return splitSet(issuers)
+}
+
+// getTrustedProxies parses the trustedProxies setting. Single IP addresses are treated as networks
+// containing only that address.
+func getTrustedProxies() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range splitList(settings.getString("trustedProxies")) {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy '%s', expected an IP address or CIDR range", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s', expected an IP address or CIDR range", v)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// splitSet splits a comma separated list into a set, ignoring empty values.
+func splitSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range splitList(s) {
+		set[v] = true
+	}
+	return set
+}
+
+// splitList splits a comma separated list, ignoring empty values.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
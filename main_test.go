@@ -1,76 +1,412 @@
 package main
 
-import "testing"
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetKeysFromEnvironment(t *testing.T) {
+	publicKey := testKeys["example.com"]
+	block, _ := pem.Decode([]byte(publicKey))
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey := pub.(*rsa.PublicKey)
+	// Keys which aren't PEM encoded are converted to PEM.
+	converted := string(pem.EncodeToMemory(block))
+	jwk := fmt.Sprintf(`{"kty":"RSA","n":"%s","e":"AQAB"}`, base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()))
+
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pemFile := filepath.Join(dir, "example.com.pem")
+	derFile := filepath.Join(dir, "example.com.der")
+	if err := ioutil.WriteFile(pemFile, []byte(publicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(derFile, x509.MarshalPKCS1PublicKey(rsaKey), 0600); err != nil {
+		t.Fatal(err)
+	}
 
-func TestThatPathsAreJoinedWithASlash(t *testing.T) {
 	tests := []struct {
-		a        string
-		b        string
-		expected string
+		input         []string
+		expected      map[string]string
+		expectedError string
 	}{
 		{
-			a:        "/test/",
-			b:        "/b/",
-			expected: "/test/b/",
+			input: []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_0=dsfdsfdsfdsf"},
+			expected: map[string]string{
+				"example.com": "dsfdsfdsfdsf",
+			},
+		},
+		{
+			input:    []string{"unrelated=something"},
+			expected: map[string]string{},
+		},
+		{
+			input:         []string{"JWTPROXY_ISSUER_1=example.com", "JWTPROXY_PUBLIC_KEY_0=dsfdsfdsfdsf"},
+			expected:      map[string]string{},
+			expectedError: "could not find a matching JWTPROXY_PUBLIC_KEY_1 or JWTPROXY_PUBLIC_KEY_FILE_1 value for JWTPROXY_ISSUER_1",
+		},
+		{
+			input:    []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_0=a2V5=="},
+			expected: map[string]string{"example.com": "a2V5=="},
+		},
+		{
+			input:    []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_0=" + base64.StdEncoding.EncodeToString([]byte(publicKey))},
+			expected: map[string]string{"example.com": publicKey},
 		},
 		{
-			a:        "test",
-			b:        "b",
-			expected: "test/b",
+			input:    []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_0=" + base64.StdEncoding.EncodeToString(block.Bytes)},
+			expected: map[string]string{"example.com": converted},
 		},
 		{
-			a:        "test",
-			b:        "/b",
-			expected: "test/b",
+			input:    []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_0=" + jwk},
+			expected: map[string]string{"example.com": converted},
 		},
 		{
-			a:        "test/",
-			b:        "b",
-			expected: "test/b",
+			input:    []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_FILE_0=" + pemFile},
+			expected: map[string]string{"example.com": publicKey},
+		},
+		{
+			input:    []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_FILE_0=" + derFile},
+			expected: map[string]string{"example.com": converted},
+		},
+		{
+			input:         []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_FILE_0=" + filepath.Join(dir, "missing.pem")},
+			expected:      map[string]string{},
+			expectedError: "Failed to read file",
+		},
+		{
+			input:         []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_0=" + publicKey, "JWTPROXY_PUBLIC_KEY_FILE_0=" + pemFile},
+			expected:      map[string]string{},
+			expectedError: "only one of JWTPROXY_PUBLIC_KEY_0 or JWTPROXY_PUBLIC_KEY_FILE_0 can be set",
 		},
 	}
 
 	for _, test := range tests {
-		actual := singleJoiningSlash(test.a, test.b)
+		actual, err := getKeysFromEnvironment(test.input)
+		if err != nil && test.expectedError == "" {
+			t.Error(err)
+		}
+		if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+			t.Errorf("for input '%v', expected error '%v', got %v", test.input, test.expectedError, err)
+		}
+		if !mapsAreEqual(actual, test.expected) {
+			t.Errorf("for input '%v', expected '%v', got '%v'", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestGetClientAuth(t *testing.T) {
+	tests := []struct {
+		clientAuth    string
+		expected      tls.ClientAuthType
+		expectedError string
+	}{
+		{clientAuth: "", expected: tls.NoClientCert},
+		{clientAuth: "none", expected: tls.NoClientCert},
+		{clientAuth: "request", expected: tls.VerifyClientCertIfGiven},
+		{clientAuth: "require", expected: tls.RequireAndVerifyClientCert},
+		{clientAuth: "Require", expectedError: "invalid client auth 'Require', expected one of 'none', 'request' or 'require'"},
+		{clientAuth: "optional", expectedError: "invalid client auth 'optional'"},
+	}
+
+	defer func(s *settingSources) { settings = s }(settings)
+	for _, test := range tests {
+		env := map[string]string{"JWTPROXY_CLIENT_AUTH": test.clientAuth}
+		settings = &settingSources{flags: flag.NewFlagSet("jwtproxy", flag.ContinueOnError), getenv: func(name string) string { return env[name] }}
+		flag.CommandLine.VisitAll(func(f *flag.Flag) {
+			settings.flags.String(f.Name, f.DefValue, f.Usage)
+		})
+
+		actual, err := getClientAuth()
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("'%s': expected error '%s', but got %v", test.clientAuth, test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %v", test.clientAuth, err)
+		}
 		if actual != test.expected {
-			t.Errorf("for '%v' and '%v', expected '%v' got '%v'", test.a, test.b, test.expected, actual)
+			t.Errorf("'%s': expected %v, but got %v", test.clientAuth, test.expected, actual)
 		}
 	}
 }
 
-func TestGetKeysFromEnvironment(t *testing.T) {
+func TestGetTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
 	tests := []struct {
-		input         []string
+		name               string
+		authMode           string
+		env                map[string]string
+		expectedConfig     bool
+		expectedClientAuth tls.ClientAuthType
+		expectedClientCAs  bool
+		expectedError      string
+	}{
+		{
+			name:     "TLS is optional for JWT authentication",
+			authMode: authModeJWT,
+		},
+		{
+			name:          "client certificate authentication requires TLS",
+			authMode:      authModeCert,
+			expectedError: "client certificate authentication requires the JWTPROXY_TLS_CERT and JWTPROXY_TLS_KEY",
+		},
+		{
+			name:          "requesting client certificates requires TLS",
+			authMode:      authModeJWT,
+			env:           map[string]string{"JWTPROXY_CLIENT_AUTH": "request"},
+			expectedError: "client certificate authentication requires the JWTPROXY_TLS_CERT and JWTPROXY_TLS_KEY",
+		},
+		{
+			name:          "certificate without a key",
+			authMode:      authModeJWT,
+			env:           map[string]string{"JWTPROXY_TLS_CERT": certFile},
+			expectedError: "both of the JWTPROXY_TLS_CERT and JWTPROXY_TLS_KEY",
+		},
+		{
+			name:          "invalid client auth",
+			authMode:      authModeJWT,
+			env:           map[string]string{"JWTPROXY_TLS_CERT": certFile, "JWTPROXY_TLS_KEY": keyFile, "JWTPROXY_CLIENT_AUTH": "always"},
+			expectedError: "invalid client auth 'always'",
+		},
+		{
+			name:          "client certificate authentication requires client certificates",
+			authMode:      authModeBoth,
+			env:           map[string]string{"JWTPROXY_TLS_CERT": certFile, "JWTPROXY_TLS_KEY": keyFile},
+			expectedError: "auth mode 'both' requires JWTPROXY_CLIENT_AUTH or the clientAuth command line flag to be 'request' or 'require'",
+		},
+		{
+			name:          "certificate can't be loaded",
+			authMode:      authModeJWT,
+			env:           map[string]string{"JWTPROXY_TLS_CERT": keyFile, "JWTPROXY_TLS_KEY": keyFile},
+			expectedError: "failed to load TLS certificate",
+		},
+		{
+			name:               "TLS without client certificates",
+			authMode:           authModeJWT,
+			env:                map[string]string{"JWTPROXY_TLS_CERT": certFile, "JWTPROXY_TLS_KEY": keyFile},
+			expectedConfig:     true,
+			expectedClientAuth: tls.NoClientCert,
+		},
+		{
+			name:          "client CA is required",
+			authMode:      authModeCert,
+			env:           map[string]string{"JWTPROXY_TLS_CERT": certFile, "JWTPROXY_TLS_KEY": keyFile, "JWTPROXY_CLIENT_AUTH": "require"},
+			expectedError: "JWTPROXY_CLIENT_CA environment variable or clientCA command line flag not found",
+		},
+		{
+			name:          "client CA bundle is missing",
+			authMode:      authModeCert,
+			env:           map[string]string{"JWTPROXY_TLS_CERT": certFile, "JWTPROXY_TLS_KEY": keyFile, "JWTPROXY_CLIENT_AUTH": "require", "JWTPROXY_CLIENT_CA": filepath.Join(dir, "missing.pem")},
+			expectedError: "Failed to read file " + filepath.Join(dir, "missing.pem"),
+		},
+		{
+			name:          "client CA bundle doesn't contain certificates",
+			authMode:      authModeCert,
+			env:           map[string]string{"JWTPROXY_TLS_CERT": certFile, "JWTPROXY_TLS_KEY": keyFile, "JWTPROXY_CLIENT_AUTH": "require", "JWTPROXY_CLIENT_CA": keyFile},
+			expectedError: "no PEM encoded certificates found in " + keyFile,
+		},
+		{
+			name:               "client certificates are required",
+			authMode:           authModeCert,
+			env:                map[string]string{"JWTPROXY_TLS_CERT": certFile, "JWTPROXY_TLS_KEY": keyFile, "JWTPROXY_CLIENT_AUTH": "require", "JWTPROXY_CLIENT_CA": certFile},
+			expectedConfig:     true,
+			expectedClientAuth: tls.RequireAndVerifyClientCert,
+			expectedClientCAs:  true,
+		},
+		{
+			name:               "client certificates are requested",
+			authMode:           authModeJWT,
+			env:                map[string]string{"JWTPROXY_TLS_CERT": certFile, "JWTPROXY_TLS_KEY": keyFile, "JWTPROXY_CLIENT_AUTH": "request", "JWTPROXY_CLIENT_CA": certFile},
+			expectedConfig:     true,
+			expectedClientAuth: tls.VerifyClientCertIfGiven,
+			expectedClientCAs:  true,
+		},
+	}
+
+	defer func(s *settingSources) { settings = s }(settings)
+	for _, test := range tests {
+		env := test.env
+		settings = &settingSources{flags: flag.NewFlagSet("jwtproxy", flag.ContinueOnError), getenv: func(name string) string { return env[name] }}
+		flag.CommandLine.VisitAll(func(f *flag.Flag) {
+			settings.flags.String(f.Name, f.DefValue, f.Usage)
+		})
+
+		config, err := getTLSConfig(test.authMode)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error '%s', but got %v", test.name, test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if (config != nil) != test.expectedConfig {
+			t.Errorf("%s: expected a TLS config %v, but got %v", test.name, test.expectedConfig, config != nil)
+		}
+		if config == nil {
+			continue
+		}
+		if len(config.Certificates) != 1 {
+			t.Errorf("%s: expected 1 certificate, but got %d", test.name, len(config.Certificates))
+		}
+		if config.ClientAuth != test.expectedClientAuth {
+			t.Errorf("%s: expected client auth %v, but got %v", test.name, test.expectedClientAuth, config.ClientAuth)
+		}
+		if (config.ClientCAs != nil) != test.expectedClientCAs {
+			t.Errorf("%s: expected client CAs %v, but got %v", test.name, test.expectedClientCAs, config.ClientCAs != nil)
+		}
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its private key to the directory.
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestGetClientCertificateIdentities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	identitiesFile := filepath.Join(dir, "identities.json")
+	if err := ioutil.WriteFile(identitiesFile, []byte(`{"client.example.com": "example.com"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalidFile := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalidFile, []byte(`["client.example.com"]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authMode      string
+		clientCerts   string
 		expected      map[string]string
 		expectedError string
 	}{
 		{
-			input: []string{"JWTPROXY_ISSUER_0=example.com", "JWTPROXY_PUBLIC_KEY_0=dsfdsfdsfdsf"},
-			expected: map[string]string{
-				"example.com": "dsfdsfdsfdsf",
-			},
+			name:     "not needed for JWT authentication",
+			authMode: authModeJWT,
+			expected: map[string]string{},
 		},
 		{
-			input:    []string{"unrelated=something"},
-			expected: map[string]string{},
+			name:          "required for client certificate authentication",
+			authMode:      authModeCert,
+			expectedError: "JWTPROXY_CLIENT_CERTS environment variable or clientCerts command line flag not found",
 		},
 		{
-			input:         []string{"JWTPROXY_ISSUER_1=example.com", "JWTPROXY_PUBLIC_KEY_0=dsfdsfdsfdsf"},
-			expected:      map[string]string{},
-			expectedError: "could not find a matching JWTPROXY_PUBLIC_KEY_1 value for JWTPROXY_ISSUER_1",
+			name:          "required when both are used",
+			authMode:      authModeBoth,
+			expectedError: "JWTPROXY_CLIENT_CERTS environment variable or clientCerts command line flag not found",
+		},
+		{
+			name:        "maps subjects to issuers",
+			authMode:    authModeCert,
+			clientCerts: identitiesFile,
+			expected:    map[string]string{"client.example.com": "example.com"},
+		},
+		{
+			name:        "read for JWT authentication if set",
+			authMode:    authModeJWT,
+			clientCerts: identitiesFile,
+			expected:    map[string]string{"client.example.com": "example.com"},
+		},
+		{
+			name:          "missing file",
+			authMode:      authModeCert,
+			clientCerts:   filepath.Join(dir, "missing.json"),
+			expectedError: "Failed to open file",
+		},
+		{
+			name:          "not a JSON map",
+			authMode:      authModeCert,
+			clientCerts:   invalidFile,
+			expectedError: "Failed to parse JSON file",
 		},
 	}
 
+	defer func(s *settingSources) { settings = s }(settings)
 	for _, test := range tests {
-		actual, err := getKeysFromEnvironment(test.input)
-		if err != nil && test.expectedError == "" {
-			t.Error(err)
+		env := map[string]string{"JWTPROXY_CLIENT_CERTS": test.clientCerts}
+		settings = &settingSources{flags: flag.NewFlagSet("jwtproxy", flag.ContinueOnError), getenv: func(name string) string { return env[name] }}
+		flag.CommandLine.VisitAll(func(f *flag.Flag) {
+			settings.flags.String(f.Name, f.DefValue, f.Usage)
+		})
+
+		actual, err := getClientCertificateIdentities(test.authMode)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error '%s', but got %v", test.name, test.expectedError, err)
+			}
+			continue
 		}
-		if test.expectedError != "" && err == nil {
-			t.Errorf("for input '%v', expected error '%v', got nil", test.input, test.expectedError)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
 		}
 		if !mapsAreEqual(actual, test.expected) {
-			t.Errorf("for input '%v', expected '%v', got '%v'", test.input, test.expected, actual)
+			t.Errorf("%s: expected %v, but got %v", test.name, test.expected, actual)
 		}
 	}
 }
@@ -86,3 +422,15 @@ func mapsAreEqual(m, n map[string]string) bool {
 	}
 	return true
 }
+
+var testKeys = map[string]string{
+	"example.com": `-----BEGIN PUBLIC KEY-----
+MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA05IDL+Y6VaJvUWmI4vOH
+G0mL3h8TqfQ/icg6PBiA01MPj/dHzM8mTbxsRlxEbtIHb82mOJeWavd+TmiLSPNX
+pbcNu4ZoY+LCmpxf3C2Uk3kbL7APIOEw56QTDCH9znscRC4r75uXEfv38FCXySU+
+uWmILAXXqEHHiFW2q4ieR6mHvR7qZ4gg3uJARsCMGkHMofOTtkVwjbh56lQboMWY
+8vV0ap6fg7OuRjWt4RF5fd4kU3mWYLlJPnMqcjPifiCLzlqF4EP0lfcLRwHjMuD/
+oFQers8auQMYKouhgqNuClBI4JZLznK9qULr5fuGjvJI5fS7UIY1yyvwx6NSlmSM
+nQIDAQAB
+-----END PUBLIC KEY-----`,
+}
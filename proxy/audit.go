@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// auditGenesisHash is the previous hash of the first entry in an audit log.
+var auditGenesisHash = strings.Repeat("0", 64)
+
+// AuditEntry records an authentication decision. Each entry contains the hash of the previous entry, so
+// that modifying or deleting entries can be detected. If the log has a key, the hashes are HMACs, so that
+// entries can't be modified and the chain recalculated without the key.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	JTI       string    `json:"jti"`
+	KeyID     string    `json:"kid"`
+	Path      string    `json:"path"`
+	RequestID string    `json:"requestId,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	PrevHash  string    `json:"prevHash"`
+	Hash      string    `json:"hash"`
+}
+
+const (
+	auditOutcomeAllowed = "allowed"
+	auditOutcomeDenied  = "denied"
+)
+
+// hash calculates the hash of the entry, which covers all of the fields except the hash itself. If key
+// is set, the hash is an HMAC-SHA256 using the key.
+func (e AuditEntry) hash(key []byte) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	if key != nil {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog writes hash-chained authentication decisions as JSON lines.
+type AuditLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	key  []byte
+	prev string
+}
+
+// NewAuditLog creates an AuditLog which writes to w, chaining the first entry to prevHash. If prevHash is
+// empty, the log is assumed to be new. If key is set, entries are chained using HMACs with the key.
+func NewAuditLog(w io.Writer, prevHash string, key []byte) *AuditLog {
+	if prevHash == "" {
+		prevHash = auditGenesisHash
+	}
+	return &AuditLog{
+		w:    w,
+		key:  key,
+		prev: prevHash,
+	}
+}
+
+// OpenAuditLog opens the audit log file for appending, continuing the chain from its last entry. If the
+// last entry's hash doesn't match the key, e.g. because the key has changed, an error is returned, since
+// the new entries couldn't be verified with the earlier ones.
+func OpenAuditLog(path string, key []byte) (*AuditLog, error) {
+	prev, err := lastAuditHash(path, key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open file %s with error %v", path, err)
+	}
+	return NewAuditLog(f, prev, key), nil
+}
+
+// lastAuditHash returns the hash of the last entry of the audit log, after checking it with the key.
+func lastAuditHash(path string, key []byte) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to open file %s with error %v", path, err)
+	}
+	defer f.Close()
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Failed to read file %s with error %v", path, err)
+	}
+	if last == nil {
+		return "", nil
+	}
+	var e AuditEntry
+	if err := json.Unmarshal(last, &e); err != nil {
+		return "", fmt.Errorf("failed to parse the last entry of audit log %s with error %v", path, err)
+	}
+	hash, err := e.hash(key)
+	if err != nil {
+		return "", err
+	}
+	if hash != e.Hash {
+		return "", fmt.Errorf("the hash of the last entry of audit log %s does not match, the audit key may have changed or the entry has been modified", path)
+	}
+	return e.Hash, nil
+}
+
+// Record chains the entry to the previous entry and writes it to the log.
+func (a *AuditLog) Record(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Time = e.Time.UTC()
+	e.PrevHash = a.prev
+	var err error
+	if e.Hash, err = e.hash(a.key); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = a.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log entry with error %v", err)
+	}
+	a.prev = e.Hash
+	return nil
+}
+
+// AuditVerifyOptions configures VerifyAuditLog.
+type AuditVerifyOptions struct {
+	// Key is the key the log was written with, if any.
+	Key []byte
+	// Expect is the hash of an entry which must be in the log, e.g. the last hash of an earlier
+	// verification which was stored somewhere else. Removing entries from the end of the log doesn't break
+	// the chain, so this is the only way to detect it.
+	Expect string
+}
+
+// VerifyAuditLog checks that each entry of the audit log is chained to the previous one and has not been
+// modified, returning the number of entries and the hash of the last entry.
+func VerifyAuditLog(r io.Reader, o AuditVerifyOptions) (entries int, lastHash string, err error) {
+	prev := auditGenesisHash
+	found := o.Expect == ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, prev, fmt.Errorf("line %d: failed to parse entry: %v", line, err)
+		}
+		if e.PrevHash != prev {
+			return entries, prev, fmt.Errorf("line %d: entry is not chained to the previous entry, an entry may have been removed", line)
+		}
+		hash, err := e.hash(o.Key)
+		if err != nil {
+			return entries, prev, fmt.Errorf("line %d: %v", line, err)
+		}
+		if hash != e.Hash {
+			return entries, prev, fmt.Errorf("line %d: hash does not match the entry, the entry has been modified", line)
+		}
+		entries++
+		prev = e.Hash
+		if e.Hash == o.Expect {
+			found = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, prev, err
+	}
+	if !found {
+		return entries, prev, fmt.Errorf("expected entry %s not found, entries may have been removed from the end of the log", o.Expect)
+	}
+	return entries, prev, nil
+}
+
+// newAuditEntry creates an audit entry for the request from the header and claims of a token.
+func newAuditEntry(now time.Time, r *http.Request, header map[string]interface{}, claims map[string]interface{}) AuditEntry {
+	e := AuditEntry{
+		Time: now,
+		Path: r.URL.Path,
+	}
+	if id, ok := requestIDFromContext(r.Context()); ok {
+		e.RequestID = id.Value
+	}
+	e.Issuer, _ = claims["iss"].(string)
+	e.Subject, _ = claims["sub"].(string)
+	e.JTI, _ = claims["jti"].(string)
+	e.KeyID, _ = header["kid"].(string)
+	return e
+}
+
+// unverifiedToken decodes the header and claims of a token without verifying it, so that rejected tokens
+// can be audited. The result must not be trusted.
+func unverifiedToken(token string) (header, claims map[string]interface{}) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+	decode := func(segment string) map[string]interface{} {
+		data, err := jwt.DecodeSegment(segment)
+		if err != nil {
+			return nil
+		}
+		var m map[string]interface{}
+		if json.Unmarshal(data, &m) != nil {
+			return nil
+		}
+		return m
+	}
+	return decode(parts[0]), decode(parts[1])
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogVerification(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	write := func(key []byte) (log string, lines []string, hashes []string) {
+		var buf bytes.Buffer
+		audit := NewAuditLog(&buf, "", key)
+		for _, subject := range []string{"user-1", "user-2", "user-3"} {
+			if err := audit.Record(AuditEntry{Time: time.Now(), Issuer: "example.com", Subject: subject, Outcome: auditOutcomeAllowed}); err != nil {
+				t.Fatalf("failed to record entry: %v", err)
+			}
+			hashes = append(hashes, audit.prev)
+		}
+		return buf.String(), strings.SplitAfter(strings.TrimSpace(buf.String()), "\n"), hashes
+	}
+	log, lines, hashes := write(nil)
+	keyedLog, keyedLines, keyedHashes := write(key)
+
+	// rechain modifies the subject of an entry and recalculates the hashes of the entries after it, as
+	// someone without the key would.
+	rechain := func(lines []string, index int, subject string) string {
+		var out, prev string
+		for i, line := range lines {
+			var e AuditEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatal(err)
+			}
+			if i == index {
+				e.Subject = subject
+			}
+			if i >= index {
+				e.PrevHash = prev
+				e.Hash, _ = e.hash(nil)
+			}
+			data, _ := json.Marshal(e)
+			out += string(data) + "\n"
+			prev = e.Hash
+		}
+		return out
+	}
+
+	tests := []struct {
+		name            string
+		log             string
+		options         AuditVerifyOptions
+		expectedEntries int
+		expectedError   string
+	}{
+		{
+			name:            "unmodified",
+			log:             log,
+			expectedEntries: 3,
+		},
+		{
+			name:            "unmodified and contains the expected entry",
+			log:             log,
+			options:         AuditVerifyOptions{Expect: hashes[1]},
+			expectedEntries: 3,
+		},
+		{
+			name:            "entries removed from the end",
+			log:             lines[0] + lines[1],
+			options:         AuditVerifyOptions{Expect: hashes[2]},
+			expectedEntries: 2,
+			expectedError:   "expected entry " + hashes[2] + " not found, entries may have been removed from the end of the log",
+		},
+		{
+			name:            "entries removed from the end can't be detected without the expected entry",
+			log:             lines[0] + lines[1],
+			expectedEntries: 2,
+		},
+		{
+			name:            "rechained without a key can't be detected",
+			log:             rechain(lines, 1, "user-4"),
+			expectedEntries: 3,
+		},
+		{
+			name:            "keyed",
+			log:             keyedLog,
+			options:         AuditVerifyOptions{Key: key, Expect: keyedHashes[2]},
+			expectedEntries: 3,
+		},
+		{
+			name:            "keyed log rechained without the key",
+			log:             rechain(keyedLines, 1, "user-4"),
+			options:         AuditVerifyOptions{Key: key},
+			expectedEntries: 1,
+			expectedError:   "line 2: hash does not match the entry, the entry has been modified",
+		},
+		{
+			name:            "keyed log verified with the wrong key",
+			log:             keyedLog,
+			options:         AuditVerifyOptions{Key: []byte("fedcba9876543210fedcba9876543210")},
+			expectedEntries: 0,
+			expectedError:   "line 1: hash does not match the entry, the entry has been modified",
+		},
+		{
+			name:            "modified entry",
+			log:             lines[0] + strings.Replace(lines[1], "user-2", "user-4", 1) + lines[2],
+			expectedEntries: 1,
+			expectedError:   "line 2: hash does not match the entry, the entry has been modified",
+		},
+		{
+			name:            "removed entry",
+			log:             lines[0] + lines[2],
+			expectedEntries: 1,
+			expectedError:   "line 2: entry is not chained to the previous entry, an entry may have been removed",
+		},
+		{
+			name:            "removed first entry",
+			log:             lines[1] + lines[2],
+			expectedEntries: 0,
+			expectedError:   "line 1: entry is not chained to the previous entry, an entry may have been removed",
+		},
+	}
+
+	for _, test := range tests {
+		entries, _, err := VerifyAuditLog(strings.NewReader(test.log), test.options)
+		if entries != test.expectedEntries {
+			t.Errorf("%s: expected %d verified entries, but got %d", test.name, test.expectedEntries, entries)
+		}
+		actualError := ""
+		if err != nil {
+			actualError = err.Error()
+		}
+		if actualError != test.expectedError {
+			t.Errorf("%s: expected error '%v', but got '%v'", test.name, test.expectedError, actualError)
+		}
+	}
+}
+
+func TestAuditLogContinuesChainWhenReopened(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		audit, err := OpenAuditLog(path, nil)
+		if err != nil {
+			t.Fatalf("failed to open audit log: %v", err)
+		}
+		if err := audit.Record(AuditEntry{Time: time.Now(), Outcome: auditOutcomeDenied}); err != nil {
+			t.Fatalf("failed to record entry: %v", err)
+		}
+		audit.w.(*os.File).Close()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, _, err := VerifyAuditLog(f, AuditVerifyOptions{})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if entries != 2 {
+		t.Errorf("expected 2 entries to be verified, but got %d", entries)
+	}
+}
+
+func TestAuditLogReopenedWithAnotherKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	audit, err := OpenAuditLog(path, []byte("key"))
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	if err := audit.Record(AuditEntry{Time: time.Now(), Outcome: auditOutcomeDenied}); err != nil {
+		t.Fatalf("failed to record entry: %v", err)
+	}
+	audit.w.(*os.File).Close()
+
+	tests := []struct {
+		name          string
+		key           []byte
+		expectedError string
+	}{
+		{
+			name: "same key",
+			key:  []byte("key"),
+		},
+		{
+			name:          "another key",
+			key:           []byte("other"),
+			expectedError: "does not match, the audit key may have changed",
+		},
+		{
+			name:          "no key",
+			expectedError: "does not match, the audit key may have changed",
+		},
+	}
+	for _, test := range tests {
+		audit, err := OpenAuditLog(path, test.key)
+		if audit != nil {
+			audit.w.(*os.File).Close()
+		}
+		if test.expectedError == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: expected error '%s', but got %v", test.name, test.expectedError, err)
+		}
+	}
+}
+
+func TestJWTAuthHandlerAudit(t *testing.T) {
+	tests := []struct {
+		name            string
+		authorization   string
+		expectedOutcome string
+		expectedSubject string
+		expectedReason  string
+	}{
+		{
+			name:            "allowed",
+			authorization:   "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com", "sub": "user-1", "jti": "1"}),
+			expectedOutcome: auditOutcomeAllowed,
+			expectedSubject: "user-1",
+		},
+		{
+			name:            "expired",
+			authorization:   "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com", "sub": "user-2", "exp": 1}),
+			expectedOutcome: auditOutcomeDenied,
+			expectedSubject: "user-2",
+			expectedReason:  "expired",
+		},
+		{
+			name:            "missing token",
+			expectedOutcome: auditOutcomeDenied,
+			expectedReason:  "Required authorization token not found",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		})
+		handler := NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, next)
+		handler.Audit = NewAuditLog(&buf, "", nil)
+
+		r := httptest.NewRequest("GET", "/api/user", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		var e AuditEntry
+		if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+			t.Errorf("%s: failed to parse audit entry '%s': %v", test.name, buf.String(), err)
+			continue
+		}
+		if e.Outcome != test.expectedOutcome {
+			t.Errorf("%s: expected outcome '%s', but got '%s'", test.name, test.expectedOutcome, e.Outcome)
+		}
+		if e.Subject != test.expectedSubject {
+			t.Errorf("%s: expected subject '%s', but got '%s'", test.name, test.expectedSubject, e.Subject)
+		}
+		if !strings.Contains(e.Reason, test.expectedReason) {
+			t.Errorf("%s: expected reason to contain '%s', but got '%s'", test.name, test.expectedReason, e.Reason)
+		}
+		if e.Path != "/api/user" {
+			t.Errorf("%s: expected path '/api/user', but got '%s'", test.name, e.Path)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, os.ErrClosed
+}
+
+func TestJWTAuthHandlerFailsClosedWhenAuditFails(t *testing.T) {
+	nextCalled := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+	})
+	handler := NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, next)
+	handler.Audit = NewAuditLog(failingWriter{}, "", nil)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signTestToken(t, map[string]interface{}{"iss": "example.com"}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if nextCalled {
+		t.Error("expected the request not to be proxied when the audit log can't be written")
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status code %d, but got %d", http.StatusInternalServerError, w.Code)
+	}
+}
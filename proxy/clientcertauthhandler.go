@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+type contextKey string
+
+const clientCertificateIssuerKey = contextKey("clientCertificateIssuer")
+
+// ClientCertAuthHandler authenticates incoming HTTP requests using the verified TLS client certificate
+// presented by the caller, mapping the certificate's subject or subject alternative names to an issuer.
+type ClientCertAuthHandler struct {
+	Identities map[string]string
+	Next       http.Handler
+}
+
+// NewClientCertAuthHandler creates a new ClientCertAuthHandler, passing in a map of certificate subjects
+// or subject alternative names (e.g. "CN=partner.example.com", "partner.example.com") to issuers.
+func NewClientCertAuthHandler(identities map[string]string, next http.Handler) ClientCertAuthHandler {
+	return ClientCertAuthHandler{
+		Identities: identities,
+		Next:       next,
+	}
+}
+
+func (h ClientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, span := startSpan(r.Context(), "auth.client_certificate", spanKindInternal)
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		h.unauthorized(w, r, span, "Required client certificate not found")
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	issuer, ok := h.issuer(cert)
+	if !ok {
+		h.unauthorized(w, r, span, "client certificate not recognised")
+		return
+	}
+	recordAuthentication(r, issuer, cert.Subject.String())
+	span.SetAttribute("jwtproxy.auth.issuer", issuer)
+	span.Finish()
+	ctx := context.WithValue(r.Context(), clientCertificateIssuerKey, issuer)
+	h.Next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (h ClientCertAuthHandler) unauthorized(w http.ResponseWriter, r *http.Request, span *traceSpan, reason string) {
+	recordAuthenticationFailure(r, reason)
+	span.SetError(reason)
+	span.Finish()
+	httpError(w, r, reason, http.StatusUnauthorized)
+}
+
+func (h ClientCertAuthHandler) issuer(cert *x509.Certificate) (string, bool) {
+	for _, name := range certificateNames(cert) {
+		if issuer, ok := h.Identities[name]; ok {
+			return issuer, true
+		}
+	}
+	return "", false
+}
+
+// certificateNames returns the names which can be used to identify a certificate, in order of preference:
+// the full subject, the subject common name, then the DNS, email, URI and IP subject alternative names.
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.String()}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// clientCertificateIssuer returns the issuer that the client certificate was mapped to by the
+// ClientCertAuthHandler, if any.
+func clientCertificateIssuer(r *http.Request) (string, bool) {
+	issuer, ok := r.Context().Value(clientCertificateIssuerKey).(string)
+	return issuer, ok
+}
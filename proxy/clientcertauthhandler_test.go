@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestClientCertAuthHandler(t *testing.T) {
+	tests := []struct {
+		name               string
+		certificate        *x509.Certificate
+		expectedStatusCode int
+		expectedBody       string
+		expectedIssuer     string
+	}{
+		{
+			name:               "no client certificate",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "Required client certificate not found",
+		},
+		{
+			name: "unknown certificate",
+			certificate: &x509.Certificate{
+				Subject: pkix.Name{CommonName: "unknown.example.com"},
+			},
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "client certificate not recognised",
+		},
+		{
+			name: "full subject",
+			certificate: &x509.Certificate{
+				Subject: pkix.Name{CommonName: "partner", Organization: []string{"Partner Ltd"}},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+			expectedIssuer:     "subject.example.com",
+		},
+		{
+			name: "common name",
+			certificate: &x509.Certificate{
+				Subject: pkix.Name{CommonName: "partner.example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+			expectedIssuer:     "example.com",
+		},
+		{
+			name: "DNS subject alternative name",
+			certificate: &x509.Certificate{
+				Subject:  pkix.Name{CommonName: "unknown.example.com"},
+				DNSNames: []string{"other.example.com", "partner.example.com"},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+			expectedIssuer:     "example.com",
+		},
+		{
+			name: "URI subject alternative name",
+			certificate: &x509.Certificate{
+				URIs: []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/partner"}},
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+			expectedIssuer:     "example.org",
+		},
+	}
+
+	identities := map[string]string{
+		"CN=partner,O=Partner Ltd":     "subject.example.com",
+		"partner.example.com":          "example.com",
+		"spiffe://example.org/partner": "example.org",
+	}
+
+	for _, test := range tests {
+		var actualIssuer string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actualIssuer, _ = clientCertificateIssuer(r)
+			w.Write([]byte("OK"))
+		})
+
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.certificate != nil {
+			r.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{test.certificate}},
+			}
+		}
+		w := httptest.NewRecorder()
+		NewClientCertAuthHandler(identities, next).ServeHTTP(w, r)
+
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %v, but got %v", test.name, test.expectedStatusCode, w.Code)
+		}
+		if !strings.HasPrefix(w.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body to start with '%v' but got '%v'", test.name, test.expectedBody, w.Body.String())
+		}
+		if actualIssuer != test.expectedIssuer {
+			t.Errorf("%s: expected issuer '%v' but got '%v'", test.name, test.expectedIssuer, actualIssuer)
+		}
+	}
+}
+
+func TestClientCertAndJWTIssuersMustMatch(t *testing.T) {
+	tests := []struct {
+		name               string
+		commonName         string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "matching issuer",
+			commonName:         "partner.example.com",
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "certificate for another issuer",
+			commonName:         "other.example.com",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "iss does not match client certificate",
+		},
+	}
+
+	identities := map[string]string{
+		"partner.example.com": "example.com",
+		"other.example.com":   "other.example.com",
+	}
+	token := signTestToken(t, map[string]interface{}{"iss": "example.com"})
+
+	for _, test := range tests {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		})
+		h := NewClientCertAuthHandler(identities, NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, next))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: test.commonName}}}},
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %v, but got %v", test.name, test.expectedStatusCode, w.Code)
+		}
+		if !strings.HasPrefix(w.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body to start with '%v' but got '%v'", test.name, test.expectedBody, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// Package proxy provides the HTTP handlers of jwtproxy, so that they can be embedded in other Go services.
+//
+// Requests are authenticated by a JWTAuthHandler, a ClientCertAuthHandler or both, and passed to a reverse
+// proxy created by NewReverseProxy, usually via a RewriteHandler which removes a path prefix. The verified
+// token is available to later handlers using VerifiedTokenFromContext.
+package proxy
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"container/heap"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// dpopProofLifetime is how far the "iat" of a DPoP proof may be from the current time. Proof "jti" values
+// are remembered for this long to prevent proofs from being replayed.
+const dpopProofLifetime = 5 * time.Minute
+
+// dpopReplayCacheSize is the maximum number of DPoP proof "jti" values which are remembered. When it's
+// reached, new proofs are rejected until the oldest expire.
+const dpopReplayCacheSize = 100000
+
+// verifyDPoPProof checks the DPoP header of the request, as per RFC 9449. The proof must be signed by the
+// key embedded in its header, be bound to the request method, URL and access token, be recent, not have
+// been seen before, and the access token's "cnf" claim must contain the thumbprint of the proof's key.
+func verifyDPoPProof(r *http.Request, accessToken string, claims jwt.MapClaims, now time.Time, seen *jtiCache, trustedProxies []*net.IPNet) error {
+	proofs := r.Header["Dpop"]
+	if len(proofs) == 0 {
+		return errors.New("DPoP proof not found")
+	}
+	if len(proofs) > 1 {
+		return errors.New("multiple DPoP proofs found")
+	}
+
+	var key JSONWebKey
+	// The iat claim is checked against now below, rather than against the system clock by the parser.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	proof, err := parser.Parse(proofs[0], func(token *jwt.Token) (interface{}, error) {
+		if typ, _ := token.Header["typ"].(string); typ != "dpop+jwt" {
+			return nil, errors.New("DPoP proof typ must be dpop+jwt")
+		}
+		jwk, ok := token.Header["jwk"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("DPoP proof jwk not found")
+		}
+		var err error
+		key, err = jsonWebKeyFromMap(jwk)
+		if err != nil {
+			return nil, fmt.Errorf("DPoP proof jwk not valid: %v", err)
+		}
+		pub, err := key.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("DPoP proof jwk not valid: %v", err)
+		}
+		// Only asymmetric algorithms which match the embedded key are allowed.
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			if _, ok := pub.(*rsa.PublicKey); ok {
+				return pub, nil
+			}
+		case *jwt.SigningMethodECDSA:
+			if _, ok := pub.(*ecdsa.PublicKey); ok {
+				return pub, nil
+			}
+		case *signingMethodEdDSA:
+			if _, ok := pub.(ed25519.PublicKey); ok {
+				return pub, nil
+			}
+		}
+		return nil, fmt.Errorf("DPoP proof alg %v does not match jwk", token.Header["alg"])
+	})
+	if err != nil {
+		return fmt.Errorf("DPoP proof not valid: %v", err)
+	}
+	proofClaims, ok := proof.Claims.(jwt.MapClaims)
+	if !ok {
+		return errors.New("DPoP proof claims not found")
+	}
+
+	if htm, _ := proofClaims["htm"].(string); htm != r.Method {
+		return errors.New("DPoP proof htm does not match request method")
+	}
+	if htu, _ := proofClaims["htu"].(string); !dpopURLMatches(htu, r, trustedProxies) {
+		return errors.New("DPoP proof htu does not match request URL")
+	}
+	iat, ok := proofClaims["iat"].(float64)
+	if !ok {
+		return errors.New("DPoP proof iat not found")
+	}
+	issuedAt := time.Unix(int64(iat), 0)
+	if issuedAt.Before(now.Add(-dpopProofLifetime)) || issuedAt.After(now.Add(dpopProofLifetime)) {
+		return errors.New("DPoP proof iat is not recent")
+	}
+	ath, _ := proofClaims["ath"].(string)
+	if ath != accessTokenHash(accessToken) {
+		return errors.New("DPoP proof ath does not match access token")
+	}
+
+	cnf, ok := claims["cnf"].(map[string]interface{})
+	if !ok {
+		return errors.New("cnf not found")
+	}
+	jkt, ok := cnf["jkt"].(string)
+	if !ok {
+		return errors.New("cnf jkt not found")
+	}
+	thumbprint, err := key.Thumbprint()
+	if err != nil {
+		return fmt.Errorf("DPoP proof jwk not valid: %v", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(jkt), []byte(thumbprint)) != 1 {
+		return errors.New("cnf jkt does not match DPoP proof key")
+	}
+
+	// Check for replays last, so that invalid proofs don't fill up the cache.
+	jti, _ := proofClaims["jti"].(string)
+	if jti == "" {
+		return errors.New("DPoP proof jti not found")
+	}
+	return seen.add(jti, issuedAt.Add(dpopProofLifetime), now)
+}
+
+// dpopURLMatches compares the "htu" claim to the URL of the request, ignoring any query and fragment.
+func dpopURLMatches(htu string, r *http.Request, trustedProxies []*net.IPNet) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// Allow a load balancer which terminates TLS to tell us the original scheme. Other callers could use
+	// the header to make a proof for one scheme valid for the other, so it's ignored unless the request
+	// comes from a trusted proxy.
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && fromTrustedProxy(r, trustedProxies) {
+		scheme = proto
+	}
+	return strings.EqualFold(u.Scheme, scheme) &&
+		strings.EqualFold(u.Host, r.Host) &&
+		u.Path == r.URL.Path
+}
+
+// fromTrustedProxy returns true if the request was made from one of the trusted networks.
+func fromTrustedProxy(r *http.Request, trustedProxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessTokenHash returns the base64url encoded SHA-256 hash of the access token, for comparison against
+// the "ath" claim of a DPoP proof.
+func accessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// jtiCache remembers the "jti" values of tokens until they expire. It holds at most max values, so that
+// callers can't exhaust the proxy's memory by sending proofs faster than they expire.
+type jtiCache struct {
+	mu       sync.Mutex
+	max      int
+	expiries map[string]time.Time
+	queue    jtiQueue
+}
+
+func newJTICache(max int) *jtiCache {
+	return &jtiCache{
+		max:      max,
+		expiries: make(map[string]time.Time),
+	}
+}
+
+var (
+	errJTISeen      = errors.New("DPoP proof has already been used")
+	errJTICacheFull = errors.New("DPoP replay cache is full")
+)
+
+// add records the jti. It returns an error if the jti has already been seen and has not yet expired, or
+// if the cache is full of values which haven't expired.
+func (c *jtiCache) add(jti string, expiry, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.queue) > 0 && now.After(c.queue[0].expiry) {
+		delete(c.expiries, heap.Pop(&c.queue).(jtiExpiry).jti)
+	}
+	if _, ok := c.expiries[jti]; ok {
+		return errJTISeen
+	}
+	if len(c.expiries) >= c.max {
+		return errJTICacheFull
+	}
+	c.expiries[jti] = expiry
+	heap.Push(&c.queue, jtiExpiry{jti: jti, expiry: expiry})
+	return nil
+}
+
+type jtiExpiry struct {
+	jti    string
+	expiry time.Time
+}
+
+// jtiQueue is a heap of jti values ordered by expiry, so that expired values can be removed without
+// checking every value.
+type jtiQueue []jtiExpiry
+
+func (q jtiQueue) Len() int            { return len(q) }
+func (q jtiQueue) Less(i, j int) bool  { return q[i].expiry.Before(q[j].expiry) }
+func (q jtiQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *jtiQueue) Push(x interface{}) { *q = append(*q, x.(jtiExpiry)) }
+func (q *jtiQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
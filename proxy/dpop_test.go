@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestDPoP(t *testing.T) {
+	proofKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	jwk := JSONWebKey{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(proofKey.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(proofKey.Y.Bytes()),
+	}
+	jkt, err := jwk.Thumbprint()
+	if err != nil {
+		t.Fatalf("failed to calculate thumbprint: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	boundToken := signTestToken(t, map[string]interface{}{"iss": "example.com", "cnf": map[string]interface{}{"jkt": jkt}})
+	unboundToken := signTestToken(t, map[string]interface{}{"iss": "example.com"})
+
+	proof := func(claims jwt.MapClaims, key *ecdsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["typ"] = "dpop+jwt"
+		token.Header["jwk"] = jwk
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("failed to sign proof: %v", err)
+		}
+		return signed
+	}
+	proofClaims := func(jti string, modify func(c jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"jti": jti,
+			"htm": "GET",
+			"htu": "http://example.com/api/user",
+			"iat": time.Now().Unix(),
+			"ath": accessTokenHash(boundToken),
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name               string
+		authorization      string
+		proof              string
+		remoteAddr         string
+		forwardedProto     string
+		dpopRequired       bool
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "bearer token for issuer which doesn't require DPoP",
+			authorization:      "Bearer " + unboundToken,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "bearer token for issuer which requires DPoP",
+			authorization:      "Bearer " + boundToken,
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "Authorization header format must be DPoP {token}",
+		},
+		{
+			name:               "missing proof",
+			authorization:      "DPoP " + boundToken,
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof not found",
+		},
+		{
+			name:               "valid proof",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("1", nil), proofKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "valid proof for issuer which doesn't require DPoP",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("2", nil), proofKey),
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "replayed proof",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("1", nil), proofKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof has already been used",
+		},
+		{
+			name:               "proof signed by another key",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("3", nil), otherKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof not valid",
+		},
+		{
+			name:               "wrong method",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("4", func(c jwt.MapClaims) { c["htm"] = "POST" }), proofKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof htm does not match request method",
+		},
+		{
+			name:               "wrong URL",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("5", func(c jwt.MapClaims) { c["htu"] = "http://example.com/api/admin" }), proofKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof htu does not match request URL",
+		},
+		{
+			name:               "old proof",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("6", func(c jwt.MapClaims) { c["iat"] = time.Now().Add(-time.Hour).Unix() }), proofKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof iat is not recent",
+		},
+		{
+			name:               "proof for another access token",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("7", func(c jwt.MapClaims) { c["ath"] = accessTokenHash(unboundToken) }), proofKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof ath does not match access token",
+		},
+		{
+			name:               "access token not bound to a key",
+			authorization:      "DPoP " + unboundToken,
+			proof:              proof(proofClaims("8", func(c jwt.MapClaims) { c["ath"] = accessTokenHash(unboundToken) }), proofKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "cnf not found",
+		},
+		{
+			name:               "X-Forwarded-Proto from a trusted proxy",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("9", func(c jwt.MapClaims) { c["htu"] = "https://example.com/api/user" }), proofKey),
+			remoteAddr:         "10.0.0.1:51234",
+			forwardedProto:     "https",
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "X-Forwarded-Proto from an untrusted caller is ignored",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("10", func(c jwt.MapClaims) { c["htu"] = "https://example.com/api/user" }), proofKey),
+			forwardedProto:     "https",
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof htu does not match request URL",
+		},
+		{
+			name:               "missing jti",
+			authorization:      "DPoP " + boundToken,
+			proof:              proof(proofClaims("", nil), proofKey),
+			dpopRequired:       true,
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof jti not found",
+		},
+	}
+
+	// Share the handler between tests to check that replayed proofs are rejected.
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	handler := NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys), TrustedProxies: []*net.IPNet{trusted}}, next)
+
+	for _, test := range tests {
+		handler.DPoPIssuers = map[string]bool{"example.com": test.dpopRequired}
+
+		r := httptest.NewRequest("GET", "http://example.com/api/user?id=1", nil)
+		r.Header.Set("Authorization", test.authorization)
+		if test.proof != "" {
+			r.Header.Set("DPoP", test.proof)
+		}
+		if test.remoteAddr != "" {
+			r.RemoteAddr = test.remoteAddr
+		}
+		if test.forwardedProto != "" {
+			r.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %v, but got %v", test.name, test.expectedStatusCode, w.Code)
+		}
+		if !strings.HasPrefix(w.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body to start with '%v' but got '%v'", test.name, test.expectedBody, w.Body.String())
+		}
+	}
+}
+
+func TestDPoPEdDSAProof(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	jwk, err := NewJSONWebKey(pub)
+	if err != nil {
+		t.Fatalf("failed to create jwk: %v", err)
+	}
+	jkt, err := jwk.Thumbprint()
+	if err != nil {
+		t.Fatalf("failed to calculate thumbprint: %v", err)
+	}
+
+	// Validate tokens as at a time which is hours away from the system clock, to check that the proof's
+	// iat is compared against the handler's time.
+	now := time.Now().Add(3 * time.Hour)
+	token := signTestToken(t, map[string]interface{}{
+		"iss": "example.com",
+		"exp": now.Add(time.Hour).Unix(),
+		"cnf": map[string]interface{}{"jkt": jkt},
+	})
+	handler := NewJWTAuthHandler(JWTAuthOptions{
+		Keys: NewKeyStore(testKeys),
+		Now:  func() time.Time { return now },
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+
+	tests := []struct {
+		name               string
+		iat                time.Time
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "proof issued at the handler's time",
+			iat:                now,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "proof issued at the system time",
+			iat:                time.Now(),
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "DPoP proof iat is not recent",
+		},
+	}
+
+	for i, test := range tests {
+		proof := jwt.NewWithClaims(signingMethodEd25519, jwt.MapClaims{
+			"jti": strconv.Itoa(i),
+			"htm": "GET",
+			"htu": "http://example.com/api/user",
+			"iat": test.iat.Unix(),
+			"ath": accessTokenHash(token),
+		})
+		proof.Header["typ"] = "dpop+jwt"
+		proof.Header["jwk"] = jwk
+		signed, err := proof.SignedString(priv)
+		if err != nil {
+			t.Fatalf("failed to sign proof: %v", err)
+		}
+
+		r := httptest.NewRequest("GET", "http://example.com/api/user", nil)
+		r.Header.Set("Authorization", "DPoP "+token)
+		r.Header.Set("DPoP", signed)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %v, but got %v", test.name, test.expectedStatusCode, w.Code)
+		}
+		if !strings.HasPrefix(w.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body to start with '%v' but got '%v'", test.name, test.expectedBody, w.Body.String())
+		}
+	}
+}
+
+func TestJTICache(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newJTICache(2)
+
+	tests := []struct {
+		name          string
+		jti           string
+		expiry        time.Time
+		now           time.Time
+		expectedError error
+	}{
+		{
+			name:   "new jti",
+			jti:    "1",
+			expiry: now.Add(2 * time.Minute),
+			now:    now,
+		},
+		{
+			name:          "seen jti",
+			jti:           "1",
+			expiry:        now.Add(2 * time.Minute),
+			now:           now,
+			expectedError: errJTISeen,
+		},
+		{
+			name:   "second jti",
+			jti:    "2",
+			expiry: now.Add(time.Minute),
+			now:    now,
+		},
+		{
+			name:          "full cache",
+			jti:           "3",
+			expiry:        now.Add(time.Minute),
+			now:           now,
+			expectedError: errJTICacheFull,
+		},
+		{
+			name:   "the first jti to expire is removed",
+			jti:    "3",
+			expiry: now.Add(3 * time.Minute),
+			now:    now.Add(90 * time.Second),
+		},
+		{
+			name:          "jti which hasn't expired is still seen",
+			jti:           "1",
+			expiry:        now.Add(4 * time.Minute),
+			now:           now.Add(90 * time.Second),
+			expectedError: errJTISeen,
+		},
+		{
+			name:   "expired jti can be used again",
+			jti:    "1",
+			expiry: now.Add(5 * time.Minute),
+			now:    now.Add(150 * time.Second),
+		},
+	}
+
+	for _, test := range tests {
+		if err := c.add(test.jti, test.expiry, test.now); err != test.expectedError {
+			t.Errorf("%s: expected error %v, but got %v", test.name, test.expectedError, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"errors"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// signingMethodEdDSA signs and verifies tokens with Ed25519 keys, as per RFC 8037, since jwt-go only
+// supports RSA, ECDSA and HMAC.
+type signingMethodEdDSA struct{}
+
+var signingMethodEd25519 = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEd25519.Alg(), func() jwt.SigningMethod {
+		return signingMethodEd25519
+	})
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthCheckHandler returns HTTP 200 and 'OK' when hit, passing non-matching requests
+// through to the next handler. While the proxy is draining connections, it returns HTTP 503.
+//
+// The optional LivenessPath always returns HTTP 200 while the process is running, and the
+// optional ReadinessPath returns HTTP 200 only if the proxy is not draining and all of the
+// Checks pass.
+type HealthCheckHandler struct {
+	Path          string
+	LivenessPath  string
+	ReadinessPath string
+	Checks        []HealthCheck
+	// JSON returns a JSON body detailing the result of each check, rather than plain text.
+	JSON     bool
+	Draining func() bool
+	Next     http.Handler
+}
+
+// HealthCheck is a named check which must pass for the proxy to be ready to receive requests.
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+type healthCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthCheckResponse struct {
+	Status string              `json:"status"`
+	Checks []healthCheckResult `json:"checks,omitempty"`
+}
+
+func (h HealthCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == h.Path:
+		recordRoute(r, "health")
+		if h.draining() {
+			h.write(w, http.StatusServiceUnavailable, "Draining", nil)
+			return
+		}
+		h.write(w, http.StatusOK, "OK", nil)
+	case h.LivenessPath != "" && r.URL.Path == h.LivenessPath:
+		recordRoute(r, "live")
+		h.write(w, http.StatusOK, "OK", nil)
+	case h.ReadinessPath != "" && r.URL.Path == h.ReadinessPath:
+		recordRoute(r, "ready")
+		h.ready(w)
+	default:
+		h.Next.ServeHTTP(w, r)
+	}
+}
+
+func (h HealthCheckHandler) ready(w http.ResponseWriter) {
+	ready := true
+	results := []healthCheckResult{{Name: "draining", Status: "ok"}}
+	if h.draining() {
+		ready = false
+		results[0] = healthCheckResult{Name: "draining", Status: "fail", Error: "the proxy is shutting down"}
+	}
+	for _, c := range h.Checks {
+		result := healthCheckResult{Name: c.Name, Status: "ok"}
+		if err := c.Check(); err != nil {
+			ready = false
+			result.Status = "fail"
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	if !ready {
+		h.write(w, http.StatusServiceUnavailable, "Not Ready", results)
+		return
+	}
+	h.write(w, http.StatusOK, "OK", results)
+}
+
+func (h HealthCheckHandler) draining() bool {
+	return h.Draining != nil && h.Draining()
+}
+
+func (h HealthCheckHandler) write(w http.ResponseWriter, status int, text string, results []healthCheckResult) {
+	if !h.JSON {
+		w.WriteHeader(status)
+		w.Write([]byte(text))
+		return
+	}
+	response := healthCheckResponse{
+		Status: "ok",
+		Checks: results,
+	}
+	if status != http.StatusOK {
+		response.Status = "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
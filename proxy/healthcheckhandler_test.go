@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthCheckHandler(t *testing.T) {
+	tests := []struct {
+		request          *http.Request
+		expectedResponse string
+	}{
+		{
+			request:          httptest.NewRequest("GET", "/healthcheck", nil), // Access the healthcheck, for the OK message.
+			expectedResponse: "OK",
+		},
+		{
+			request:          httptest.NewRequest("GET", "/", nil), // Don't access the healthcheck.
+			expectedResponse: "NextResponse",
+		},
+	}
+
+	for _, test := range tests {
+		h := HealthCheckHandler{
+			Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("NextResponse"))
+			}),
+			Path: "/healthcheck",
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, test.request)
+
+		actualResponse := rec.Body.String()
+		if actualResponse != test.expectedResponse {
+			t.Errorf("Expected response '%v', but got '%v'", test.expectedResponse, actualResponse)
+		}
+
+		if rec.Result().StatusCode != http.StatusOK {
+			t.Errorf("Expected a 200 status code but got %v", rec.Result().StatusCode)
+		}
+	}
+}
+
+func TestHealthCheckHandlerWhileDraining(t *testing.T) {
+	h := HealthCheckHandler{
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("NextResponse"))
+		}),
+		Path:     "/healthcheck",
+		Draining: func() bool { return true },
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthcheck", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 status code but got %v", rec.Code)
+	}
+	if rec.Body.String() != "Draining" {
+		t.Errorf("Expected response 'Draining', but got '%v'", rec.Body.String())
+	}
+}
+
+func TestHealthCheckHandlerLivenessAndReadiness(t *testing.T) {
+	failing := HealthCheck{Name: "upstream", Check: func() error { return errors.New("connection refused") }}
+	passing := HealthCheck{Name: "keys", Check: func() error { return nil }}
+
+	tests := []struct {
+		name               string
+		path               string
+		checks             []HealthCheck
+		draining           bool
+		json               bool
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{
+			name:               "liveness",
+			path:               "/live",
+			checks:             []HealthCheck{failing},
+			draining:           true,
+			expectedStatusCode: http.StatusOK,
+			expectedResponse:   "OK",
+		},
+		{
+			name:               "ready",
+			path:               "/ready",
+			checks:             []HealthCheck{passing},
+			expectedStatusCode: http.StatusOK,
+			expectedResponse:   "OK",
+		},
+		{
+			name:               "failing check",
+			path:               "/ready",
+			checks:             []HealthCheck{passing, failing},
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedResponse:   "Not Ready",
+		},
+		{
+			name:               "draining",
+			path:               "/ready",
+			checks:             []HealthCheck{passing},
+			draining:           true,
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedResponse:   "Not Ready",
+		},
+		{
+			name:               "JSON body",
+			path:               "/ready",
+			checks:             []HealthCheck{passing, failing},
+			json:               true,
+			expectedStatusCode: http.StatusServiceUnavailable,
+			expectedResponse:   `{"status":"unavailable","checks":[{"name":"draining","status":"ok"},{"name":"keys","status":"ok"},{"name":"upstream","status":"fail","error":"connection refused"}]}` + "\n",
+		},
+		{
+			name:               "JSON liveness",
+			path:               "/live",
+			json:               true,
+			expectedStatusCode: http.StatusOK,
+			expectedResponse:   `{"status":"ok"}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		draining := test.draining
+		h := HealthCheckHandler{
+			Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("NextResponse"))
+			}),
+			Path:          "/healthcheck",
+			LivenessPath:  "/live",
+			ReadinessPath: "/ready",
+			Checks:        test.checks,
+			JSON:          test.json,
+			Draining:      func() bool { return draining },
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+
+		if rec.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %v but got %v", test.name, test.expectedStatusCode, rec.Code)
+		}
+		if rec.Body.String() != test.expectedResponse {
+			t.Errorf("%s: expected response '%v', but got '%v'", test.name, test.expectedResponse, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JSONWebKey is a public JSON Web Key, as per RFC 7517.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	D   string `json:"d,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+}
+
+// jsonWebKeyFromMap converts a JWK held in a JWT header into a JSONWebKey.
+func jsonWebKeyFromMap(m map[string]interface{}) (JSONWebKey, error) {
+	var k JSONWebKey
+	data, err := json.Marshal(m)
+	if err != nil {
+		return k, err
+	}
+	err = json.Unmarshal(data, &k)
+	return k, err
+}
+
+// PublicKey returns the public key described by the JWK.
+func (k JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	if k.D != "" {
+		return nil, errors.New("jwk must not contain a private key")
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk n: %v", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk e: %v", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid jwk e: exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, err := curveByName(k.Crv)
+		if err != nil {
+			return nil, err
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk x: %v", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk y: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid jwk: point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported jwk crv '%s'", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk x: %v", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid jwk x: wrong length")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported jwk kty '%s'", k.Kty)
+}
+
+// Thumbprint returns the base64url encoded SHA-256 thumbprint of the JWK, as per RFC 7638.
+func (k JSONWebKey) Thumbprint() (string, error) {
+	// The required members of the key, in lexicographic order.
+	var members interface{}
+	switch k.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y}
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{k.Crv, k.Kty, k.X}
+	default:
+		return "", fmt.Errorf("unsupported jwk kty '%s'", k.Kty)
+	}
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// NewJSONWebKey creates the JWK of a public key, using its thumbprint as the key ID.
+func NewJSONWebKey(pub crypto.PublicKey) (JSONWebKey, error) {
+	var k JSONWebKey
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		k = JSONWebKey{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(p.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		// The coordinates are padded to the size of the curve, as per RFC 7518.
+		size := (p.Curve.Params().BitSize + 7) / 8
+		k = JSONWebKey{
+			Kty: "EC",
+			Crv: p.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(p.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(p.Y.FillBytes(make([]byte, size))),
+		}
+	case ed25519.PublicKey:
+		k = JSONWebKey{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(p),
+		}
+	default:
+		return k, fmt.Errorf("unsupported key type %T", pub)
+	}
+	_, algorithms, err := KeyAlgorithms(pub)
+	if err != nil {
+		return k, err
+	}
+	k.Alg = algorithms[0]
+	k.Kid, err = k.Thumbprint()
+	return k, err
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("value missing")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func curveByName(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("unsupported jwk crv '%s'", name)
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// JWKSOptions configures a JWKSKeyProvider.
+type JWKSOptions struct {
+	// URLs maps each issuer to the URL of its JSON Web Key Set, e.g. an OpenID Connect provider's jwks_uri.
+	URLs map[string]string
+	// Client is used to fetch the key sets. Defaults to a client with a timeout of 10 seconds.
+	Client *http.Client
+	// MaxAge is how long a key set is used for before it's fetched again. Defaults to an hour.
+	MaxAge time.Duration
+	// MinRefreshInterval is the minimum time between fetching a key set because a token has a kid which
+	// isn't in it, so that callers can't cause the key set to be fetched on every request. Defaults to a
+	// minute.
+	MinRefreshInterval time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// JWKSKeyProvider provides the keys of issuers which publish a JSON Web Key Set, as per RFC 7517. Key
+// sets are fetched when they're first used, and again when a token has a kid which isn't in the set, so
+// that rotated keys are picked up. If a key set can't be fetched, the previous keys are kept. While a key
+// set is being fetched, tokens with a kid which is in the previous key set are verified without waiting.
+type JWKSKeyProvider struct {
+	JWKSOptions
+	sets map[string]*keySet
+}
+
+type keySet struct {
+	mu      sync.Mutex
+	keys    []Key
+	fetched time.Time
+	err     error
+	// refreshing is closed when the fetch in progress completes, and is nil if there isn't one.
+	refreshing chan struct{}
+}
+
+// NewJWKSKeyProvider creates a JWKSKeyProvider. Key sets aren't fetched until they're used.
+func NewJWKSKeyProvider(o JWKSOptions) *JWKSKeyProvider {
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if o.MaxAge == 0 {
+		o.MaxAge = time.Hour
+	}
+	if o.MinRefreshInterval == 0 {
+		o.MinRefreshInterval = time.Minute
+	}
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+	sets := make(map[string]*keySet, len(o.URLs))
+	for issuer := range o.URLs {
+		sets[issuer] = &keySet{}
+	}
+	return &JWKSKeyProvider{JWKSOptions: o, sets: sets}
+}
+
+// Key returns the key of the issuer with the kid. If the token doesn't have a kid, the key set must
+// contain a single key. If the key set can't be fetched, and the key isn't in the previous key set,
+// the fetch error is returned. If the kid isn't in the key set, Key waits for the key set to be fetched
+// again, or for the fetch in progress, only if the key set was last fetched at least MinRefreshInterval
+// ago.
+func (p *JWKSKeyProvider) Key(issuer, kid string) (Key, error) {
+	s, ok := p.sets[issuer]
+	if !ok {
+		return Key{}, ErrKeyNotFound
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := p.Now()
+	// Wait for the first fetch, but use the previous keys while the key set is refreshed.
+	if s.fetched.IsZero() || (s.refreshing == nil && now.Sub(s.fetched) >= p.MaxAge) {
+		p.refresh(s, issuer, now)
+	}
+	if k, ok := s.find(kid); ok {
+		return k, nil
+	}
+	if now.Sub(s.fetched) >= p.MinRefreshInterval {
+		p.refresh(s, issuer, now)
+		if k, ok := s.find(kid); ok {
+			return k, nil
+		}
+	}
+	if s.err != nil {
+		return Key{}, s.err
+	}
+	return Key{}, ErrKeyNotFound
+}
+
+func (s *keySet) find(kid string) (Key, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		return s.keys[0], true
+	}
+	for _, k := range s.keys {
+		if k.KeyID == kid {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// refresh replaces the keys in the set, or waits for the fetch in progress to do so. It must be called
+// with s.mu held, which is released during the fetch. If the keys can't be fetched, the previous keys are
+// kept. The set is marked as fetched at now once the fetch completes.
+func (p *JWKSKeyProvider) refresh(s *keySet, issuer string, now time.Time) {
+	if done := s.refreshing; done != nil {
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+		return
+	}
+	done := make(chan struct{})
+	s.refreshing = done
+	s.mu.Unlock()
+	keys, err := p.fetchKeys(issuer, p.URLs[issuer])
+	s.mu.Lock()
+	s.fetched, s.err = now, err
+	if err == nil {
+		s.keys = keys
+	}
+	s.refreshing = nil
+	close(done)
+}
+
+func (p *JWKSKeyProvider) fetchKeys(issuer, url string) ([]Key, error) {
+	resp, err := p.Client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch key set %s with error %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch key set %s with status %d", url, resp.StatusCode)
+	}
+	return parseKeySet(issuer, resp.Body)
+}
+
+// maxKeySetBytes is the maximum size of a key set, so that a misbehaving server can't exhaust memory.
+const maxKeySetBytes = 1 << 20
+
+// parseKeySet parses a JSON Web Key Set. Keys which aren't used for signatures, and keys of types which
+// aren't supported, are ignored, since a key set may be shared with other applications.
+func parseKeySet(issuer string, r io.Reader) ([]Key, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxKeySetBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxKeySetBytes {
+		return nil, fmt.Errorf("Failed to parse key set, it's larger than %d bytes", maxKeySetBytes)
+	}
+	var set struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("Failed to parse key set with error %v", err)
+	}
+	var keys []Key
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, Key{Issuer: issuer, KeyID: jwk.Kid, PublicKey: pub})
+	}
+	return keys, nil
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJWKSKeyProvider(t *testing.T) {
+	rsaKey, err := ParseKey("example.com", testKeys["example.com"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaJWK, err := NewJSONWebKey(rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecJWK, err := NewJSONWebKey(ecKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptionJWK := ecJWK
+	encryptionJWK.Kid, encryptionJWK.Use = "encryption", "enc"
+
+	var keys []JSONWebKey
+	status, fetches := http.StatusOK, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewJWKSKeyProvider(JWKSOptions{
+		URLs: map[string]string{"example.com": server.URL},
+		Now:  func() time.Time { return now },
+	})
+
+	tests := []struct {
+		name            string
+		keys            []JSONWebKey
+		status          int
+		advance         time.Duration
+		issuer          string
+		kid             string
+		expectedKID     string
+		expectedError   error
+		expectedFetches int
+	}{
+		{
+			name:            "a token without a kid uses the only key",
+			keys:            []JSONWebKey{rsaJWK},
+			kid:             "",
+			expectedKID:     rsaJWK.Kid,
+			expectedFetches: 1,
+		},
+		{
+			name:            "the key set is cached",
+			keys:            []JSONWebKey{rsaJWK, ecJWK},
+			kid:             rsaJWK.Kid,
+			expectedKID:     rsaJWK.Kid,
+			expectedFetches: 1,
+		},
+		{
+			name:            "an unknown kid fetches the key set again",
+			advance:         time.Minute,
+			kid:             ecJWK.Kid,
+			expectedKID:     ecJWK.Kid,
+			expectedFetches: 2,
+		},
+		{
+			name:            "an unknown kid can't fetch the key set again too soon",
+			kid:             "unknown",
+			expectedError:   ErrKeyNotFound,
+			expectedFetches: 2,
+		},
+		{
+			name:            "keys which aren't for signatures are ignored",
+			keys:            []JSONWebKey{rsaJWK, ecJWK, encryptionJWK},
+			advance:         time.Minute,
+			kid:             "encryption",
+			expectedError:   ErrKeyNotFound,
+			expectedFetches: 3,
+		},
+		{
+			name:            "a token without a kid can't choose between keys",
+			kid:             "",
+			expectedError:   ErrKeyNotFound,
+			expectedFetches: 3,
+		},
+		{
+			name:            "the previous keys are used if the key set can't be fetched",
+			status:          http.StatusInternalServerError,
+			advance:         time.Hour,
+			kid:             ecJWK.Kid,
+			expectedKID:     ecJWK.Kid,
+			expectedFetches: 4,
+		},
+		{
+			name:            "unknown issuer",
+			issuer:          "example.org",
+			expectedError:   ErrKeyNotFound,
+			expectedFetches: 4,
+		},
+	}
+
+	for _, test := range tests {
+		if test.keys != nil {
+			keys = test.keys
+		}
+		status = http.StatusOK
+		if test.status != 0 {
+			status = test.status
+		}
+		now = now.Add(test.advance)
+		issuer := test.issuer
+		if issuer == "" {
+			issuer = "example.com"
+		}
+		k, err := p.Key(issuer, test.kid)
+		if err != test.expectedError {
+			t.Errorf("%s: expected error %v, but got %v", test.name, test.expectedError, err)
+		}
+		if k.KeyID != test.expectedKID {
+			t.Errorf("%s: expected kid '%s', but got '%s'", test.name, test.expectedKID, k.KeyID)
+		}
+		if fetches != test.expectedFetches {
+			t.Errorf("%s: expected %d fetches, but got %d", test.name, test.expectedFetches, fetches)
+		}
+	}
+}
+
+func TestJWKSKeyProviderFetchError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	p := NewJWKSKeyProvider(JWKSOptions{URLs: map[string]string{"example.com": server.URL}})
+	handler := NewJWTAuthHandler(JWTAuthOptions{Keys: p}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signTestToken(t, map[string]interface{}{"iss": "example.com"}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status code %d, but got %d: %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+	if _, err := p.Key("example.com", ""); err == nil || err == ErrKeyNotFound {
+		t.Errorf("expected the fetch error, but got %v", err)
+	}
+	var steps []string
+	handler.Validate(signTestToken(t, map[string]interface{}{"iss": "example.com"}), func(step string, err error, detail string) {
+		if err == nil {
+			steps = append(steps, step)
+		}
+	})
+	for _, step := range steps {
+		if step == "iss" {
+			t.Errorf("expected the issuer not to be recorded as valid when its keys can't be fetched, but got steps %v", steps)
+		}
+	}
+}
+
+func TestJWKSKeyProviderLargeKeySet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys": [`))
+		w.Write(bytes.Repeat([]byte(" "), maxKeySetBytes))
+		w.Write([]byte(`]}`))
+	}))
+	defer server.Close()
+
+	p := NewJWKSKeyProvider(JWKSOptions{URLs: map[string]string{"example.com": server.URL}})
+	if _, err := p.Key("example.com", ""); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("expected the key set to be rejected for its size, but got %v", err)
+	}
+}
+
+func TestJWKSKeyProviderHangingServer(t *testing.T) {
+	if timeout := NewJWKSKeyProvider(JWKSOptions{}).Client.Timeout; timeout != 10*time.Second {
+		t.Errorf("expected the default client to time out after 10s, but got %v", timeout)
+	}
+	rsaKey, err := ParseKey("example.com", testKeys["example.com"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaJWK, err := NewJSONWebKey(rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key set is served once, then the server hangs until the test ends.
+	requests, release := make(chan int, 10), make(chan struct{})
+	var mu sync.Mutex
+	count := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		n := count
+		mu.Unlock()
+		requests <- n
+		if n > 1 {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []JSONWebKey{rsaJWK}})
+	}))
+	defer server.Close()
+	defer close(release)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := NewJWKSKeyProvider(JWKSOptions{
+		URLs:   map[string]string{"example.com": server.URL},
+		Client: &http.Client{Timeout: time.Minute},
+		Now:    func() time.Time { return now },
+	})
+	if _, err := p.Key("example.com", rsaJWK.Kid); err != nil {
+		t.Fatalf("unexpected error fetching the key set: %v", err)
+	}
+	<-requests
+
+	// Once the key set has expired, the next request refreshes it, and the refresh hangs.
+	now = now.Add(time.Hour)
+	refreshed := make(chan error, 1)
+	go func() {
+		_, err := p.Key("example.com", rsaJWK.Kid)
+		refreshed <- err
+	}()
+	<-requests
+
+	if k, err := p.Key("example.com", rsaJWK.Kid); err != nil || k.KeyID != rsaJWK.Kid {
+		t.Errorf("expected the cached key while the key set is refreshed, but got %v", err)
+	}
+	select {
+	case err := <-refreshed:
+		t.Errorf("expected the refresh to hang, but it completed with %v", err)
+	default:
+	}
+
+	// If there are no cached keys, the first fetch fails when the client times out.
+	p = NewJWKSKeyProvider(JWKSOptions{
+		URLs:   map[string]string{"example.com": server.URL},
+		Client: &http.Client{Timeout: 100 * time.Millisecond},
+	})
+	if _, err := p.Key("example.com", rsaJWK.Kid); err == nil || err == ErrKeyNotFound {
+		t.Errorf("expected the fetch to time out, but got %v", err)
+	}
+}
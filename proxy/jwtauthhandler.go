@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// JWTAuthOptions configures a JWTAuthHandler.
+type JWTAuthOptions struct {
+	// Keys provides the public RSA, EC or Ed25519 key of each issuer, e.g. a KeyStore, FileKeyProvider,
+	// DirectoryKeyProvider or JWKSKeyProvider.
+	Keys KeyProvider
+	// CertificateBoundIssuers is the set of issuers whose tokens must be bound to the client certificate
+	// used to make the request by a "cnf" claim containing the certificate's "x5t#S256" thumbprint.
+	CertificateBoundIssuers map[string]bool
+	// DPoPIssuers is the set of issuers whose tokens must be sent using the DPoP authorization scheme, with a
+	// DPoP proof of possession of the key referenced by the token's "cnf" claim.
+	DPoPIssuers map[string]bool
+	// TrustedProxies are the networks of load balancers which are trusted to set the X-Forwarded-Proto
+	// header, which is used to check the URL of DPoP proofs. The header is ignored from other callers.
+	TrustedProxies []*net.IPNet
+	// AllowExpiredCertificates accepts tokens from issuers whose key is an expired certificate. By default,
+	// the tokens are rejected.
+	AllowExpiredCertificates bool
+	// Audit records each authentication decision, if set.
+	Audit *AuditLog
+	// Now returns the time that tokens are validated at. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// JWTAuthHandler provides the capability to authenticate incoming HTTP requests.
+type JWTAuthHandler struct {
+	JWTAuthOptions
+	Next       http.Handler
+	dpopProofs *jtiCache
+}
+
+// NewJWTAuthHandler creates a new JWTAuthHandler, which passes requests with a valid token to next.
+func NewJWTAuthHandler(o JWTAuthOptions, next http.Handler) JWTAuthHandler {
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+	return JWTAuthHandler{
+		JWTAuthOptions: o,
+		Next:           next,
+		dpopProofs:     newJTICache(dpopReplayCacheSize),
+	}
+}
+
+const tokenKey = contextKey("token")
+
+// VerifiedToken identifies the caller authenticated by a JWTAuthHandler.
+type VerifiedToken struct {
+	Issuer  string
+	Subject string
+	// KeyID is the token's "kid" header, if it has one.
+	KeyID string
+	// Expiry is when the token expires.
+	Expiry time.Time
+	// Claims are all of the token's claims.
+	Claims map[string]interface{}
+}
+
+// VerifiedTokenFromContext returns the token verified by the JWTAuthHandler.
+func VerifiedTokenFromContext(ctx context.Context) (VerifiedToken, bool) {
+	token, ok := ctx.Value(tokenKey).(*jwt.Token)
+	if !ok {
+		return VerifiedToken{}, false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return VerifiedToken{}, false
+	}
+	t := VerifiedToken{Claims: claims}
+	t.Issuer, _ = claims["iss"].(string)
+	t.Subject, _ = claims["sub"].(string)
+	t.KeyID, _ = token.Header["kid"].(string)
+	t.Expiry, _ = claimUnixTime(claims["exp"])
+	return t, true
+}
+
+// ClaimsFromContext returns the claims of the token verified by the JWTAuthHandler.
+func ClaimsFromContext(ctx context.Context) (claims map[string]interface{}, ok bool) {
+	t, ok := VerifiedTokenFromContext(ctx)
+	return t.Claims, ok
+}
+
+func (jwth JWTAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, span := startSpan(r.Context(), "auth.jwt", spanKindInternal)
+	r, claims, err := jwth.authenticate(w, r)
+	if issuer, ok := claims["iss"].(string); ok {
+		span.SetAttribute("jwtproxy.auth.issuer", issuer)
+	}
+	if err != nil {
+		span.SetError(err.Error())
+	}
+	span.Finish()
+	if err != nil {
+		return
+	}
+	jwth.Next.ServeHTTP(w, r)
+}
+
+// authenticate validates the request's token, writing an error response if it's not valid.
+// The returned request contains the verified token.
+func (jwth JWTAuthHandler) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, jwt.MapClaims, error) {
+	// Browsers don't send credentials with CORS preflight requests, so they're not authenticated.
+	if r.Method == http.MethodOptions {
+		return r, jwt.MapClaims{}, nil
+	}
+	raw, err := fromAuthHeader(r)
+	if err == nil && raw == "" {
+		err = errors.New("Required authorization token not found")
+	}
+	var token *jwt.Token
+	if err == nil {
+		token, err = jwth.validate(raw, nil)
+	}
+	if err != nil {
+		var claims jwt.MapClaims
+		if token != nil && token.Valid {
+			claims = token.Claims.(jwt.MapClaims)
+		}
+		jwth.rejected(r, err.Error())
+		httpError(w, r, err.Error(), http.StatusUnauthorized)
+		return r, claims, err
+	}
+	r = r.WithContext(context.WithValue(r.Context(), tokenKey, token))
+	claims := jwth.claims(r)
+	if err := jwth.verifySender(r, claims); err != nil {
+		jwth.rejected(r, err.Error())
+		httpError(w, r, err.Error(), http.StatusUnauthorized)
+		return r, claims, err
+	}
+	if err := jwth.allowed(r, claims); err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return r, claims, err
+	}
+	return r, claims, nil
+}
+
+// allowed records that the request was authenticated. If the decision can't be audited, the request must
+// not proceed.
+func (jwth JWTAuthHandler) allowed(r *http.Request, claims jwt.MapClaims) error {
+	if t, ok := VerifiedTokenFromContext(r.Context()); ok {
+		recordToken(r, t)
+	}
+	if jwth.Audit == nil {
+		return nil
+	}
+	var header map[string]interface{}
+	if token, ok := r.Context().Value(tokenKey).(*jwt.Token); ok {
+		header = token.Header
+	}
+	e := newAuditEntry(jwth.Now(), r, header, claims)
+	e.Outcome = auditOutcomeAllowed
+	if err := jwth.Audit.Record(e); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errors.New("failed to audit authentication")
+	}
+	return nil
+}
+
+// rejected records that authentication failed.
+func (jwth JWTAuthHandler) rejected(r *http.Request, reason string) {
+	recordAuthenticationFailure(r, reason)
+	if jwth.Audit == nil {
+		return
+	}
+	_, token := authorization(r)
+	header, claims := unverifiedToken(token)
+	e := newAuditEntry(jwth.Now(), r, header, claims)
+	e.Outcome = auditOutcomeDenied
+	e.Reason = reason
+	if err := jwth.Audit.Record(e); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// verifySender checks that a validated token is being used by the party it was issued to.
+func (jwth JWTAuthHandler) verifySender(r *http.Request, claims jwt.MapClaims) error {
+	issuer, _ := claims["iss"].(string)
+	// If the request has already been authenticated by a client certificate, the token must have been
+	// issued to the same party.
+	if certIssuer, ok := clientCertificateIssuer(r); ok && issuer != certIssuer {
+		return errors.New("iss does not match client certificate")
+	}
+	if jwth.CertificateBoundIssuers[issuer] {
+		if err := verifyCertificateBinding(r, claims); err != nil {
+			return err
+		}
+	}
+	// Tokens sent using the DPoP scheme are always checked, even if the issuer doesn't require it.
+	scheme, accessToken := authorization(r)
+	if strings.EqualFold(scheme, "dpop") {
+		return verifyDPoPProof(r, accessToken, claims, jwth.Now(), jwth.dpopProofs, jwth.TrustedProxies)
+	}
+	if jwth.DPoPIssuers[issuer] {
+		return errors.New("Authorization header format must be DPoP {token}")
+	}
+	return nil
+}
+
+// verifyCertificateBinding checks that the token's "cnf" claim contains the SHA-256 thumbprint of the client
+// certificate used to make the request, as per RFC 8705.
+func verifyCertificateBinding(r *http.Request, claims jwt.MapClaims) error {
+	cnf, ok := claims["cnf"].(map[string]interface{})
+	if !ok {
+		return errors.New("cnf not found")
+	}
+	thumbprint, ok := cnf["x5t#S256"].(string)
+	if !ok {
+		return errors.New("cnf x5t#S256 not found")
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("certificate-bound token used without a client certificate")
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(thumbprint), []byte(expected)) != 1 {
+		return errors.New("cnf x5t#S256 does not match client certificate")
+	}
+	return nil
+}
+
+// claims returns the claims of the validated token.
+func (jwth JWTAuthHandler) claims(r *http.Request) jwt.MapClaims {
+	token, ok := r.Context().Value(tokenKey).(*jwt.Token)
+	if !ok {
+		return jwt.MapClaims{}
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return jwt.MapClaims{}
+	}
+	return claims
+}
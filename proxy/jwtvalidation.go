@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Tokens are validated here, rather than by the go-jwt-middleware package that the proxy used to use, so
+// that the verify command can report the result of each step, and so that the key is chosen by the
+// token's "iss" and "kid" before the signature is checked. The checks and error messages are the same as
+// the middleware's: the Authorization header must use the Bearer (or DPoP) scheme, the token must have an
+// "exp" in the future and a known issuer, its "alg" must match the issuer's key, and the "iat" and "nbf"
+// claims, if present, must not be in the future.
+
+// ValidationTrace receives the result of each step of validating a token.
+type ValidationTrace func(step string, err error, detail string)
+
+func (t ValidationTrace) record(step string, err error, format string, a ...interface{}) error {
+	if t != nil {
+		t(step, err, fmt.Sprintf(format, a...))
+	}
+	return err
+}
+
+// Validate checks a token in the same way as the handler, apart from the checks which depend on the
+// request, such as DPoP proofs. It returns the token's claims, or the error which would be returned to the
+// caller. If trace is set, the result of each step is passed to it, e.g. to explain why a token was rejected.
+func (jwth JWTAuthHandler) Validate(token string, trace ValidationTrace) (map[string]interface{}, error) {
+	t, err := jwth.validate(token, trace)
+	if err != nil {
+		return nil, err
+	}
+	return t.Claims.(jwt.MapClaims), nil
+}
+
+// validate parses the token, finds the key of its issuer, and verifies its signature, times and the
+// issuer's certificate.
+func (jwth JWTAuthHandler) validate(raw string, trace ValidationTrace) (*jwt.Token, error) {
+	now := jwth.Now()
+	token, parts, err := new(jwt.Parser).ParseUnverified(raw, jwt.MapClaims{})
+	if err != nil {
+		return nil, trace.record("parse", err, "")
+	}
+	trace.record("parse", nil, "signed with %s", token.Method.Alg())
+	// Assume standard claims of "iss", "exp" and "iat".
+	claims := token.Claims.(jwt.MapClaims)
+
+	if !claims.VerifyExpiresAt(now.Unix(), true) {
+		return token, trace.record("exp", errors.New("token expired"), "")
+	}
+	trace.record("exp", nil, "expires %s", claimTime(claims["exp"]))
+
+	// Find the public key to match the issuer.
+	issuerClaim, ok := claims["iss"]
+	if !ok {
+		return token, trace.record("iss", errors.New("iss not found"), "")
+	}
+	issuer, ok := issuerClaim.(string)
+	if !ok {
+		return token, trace.record("iss", errors.New("iss was not in correct format"), "")
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, err := jwth.Keys.Key(issuer, kid)
+	if err == ErrKeyNotFound {
+		if kid != "" {
+			return token, trace.record("iss", errors.New("iss not valid"), "no key for issuer '%s' with kid '%s'", issuer, kid)
+		}
+		return token, trace.record("iss", errors.New("iss not valid"), "no key for issuer '%s'", issuer)
+	}
+	if err != nil {
+		return token, trace.record("key", err, "")
+	}
+	trace.record("iss", nil, "%s", issuer)
+	info := key.Info()
+	if info.KeyID != "" {
+		trace.record("key", nil, "%s key %s (kid %s)", info.Type, info.Fingerprint, info.KeyID)
+	} else {
+		trace.record("key", nil, "%s key %s", info.Type, info.Fingerprint)
+	}
+
+	// The signing method depends on the issuer's key, so it must be checked against the key. This is
+	// important to avoid security issues described here:
+	// https://auth0.com/blog/2015/03/31/critical-vulnerabilities-in-json-web-token-libraries/
+	if err := VerifySigningMethod(token.Method, key.PublicKey); err != nil {
+		return token, trace.record("alg", err, "")
+	}
+	trace.record("alg", nil, "%s", token.Method.Alg())
+
+	if err := token.Method.Verify(strings.Join(parts[0:2], "."), parts[2], key.PublicKey); err != nil {
+		return token, trace.record("signature", err, "")
+	}
+	token.Signature = parts[2]
+	token.Valid = true
+	trace.record("signature", nil, "verified")
+
+	if !claims.VerifyIssuedAt(now.Unix(), false) {
+		return token, trace.record("iat", errors.New("Token used before issued"), "issued %s", claimTime(claims["iat"]))
+	}
+	trace.record("iat", nil, "%s", orDefault(claimTime(claims["iat"]), "not set"))
+	if !claims.VerifyNotBefore(now.Unix(), false) {
+		return token, trace.record("nbf", errors.New("Token is not valid yet"), "valid from %s", claimTime(claims["nbf"]))
+	}
+	trace.record("nbf", nil, "%s", orDefault(claimTime(claims["nbf"]), "not set"))
+
+	// If the issuer's key is a certificate, check that it hasn't expired.
+	if certs := key.Certificates; len(certs) > 0 {
+		notAfter := certs[0].NotAfter.UTC().Format(time.RFC3339)
+		if now.After(certs[0].NotAfter) && !jwth.AllowExpiredCertificates {
+			return token, trace.record("certificate", errors.New("issuer certificate expired"), "%s expired %s", certs[0].Subject, notAfter)
+		}
+		trace.record("certificate", nil, "%s expires %s", certs[0].Subject, notAfter)
+	}
+	return token, nil
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// claimTime formats a NumericDate claim.
+func claimTime(v interface{}) string {
+	if t, ok := claimUnixTime(v); ok {
+		return t.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// claimUnixTime converts a NumericDate claim to a UTC time.
+func claimUnixTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case float64:
+		return time.Unix(int64(t), 0).UTC(), true
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return time.Unix(n, 0).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// fromAuthHeader extracts the token from an "Authorization: Bearer {token}" or "Authorization: DPoP {token}" header.
+func fromAuthHeader(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") == "" {
+		return "", nil
+	}
+	scheme, token := authorization(r)
+	if !strings.EqualFold(scheme, "bearer") && !strings.EqualFold(scheme, "dpop") {
+		return "", errors.New("Authorization header format must be Bearer {token} or DPoP {token}")
+	}
+	return token, nil
+}
+
+// authorization splits the Authorization header of the request into its scheme and token.
+func authorization(r *http.Request) (scheme, token string) {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
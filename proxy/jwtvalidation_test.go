@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestValidate(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	exp := now.Add(time.Hour).Unix()
+	pem, err := ioutil.ReadFile("../example_private.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return token
+	}
+	valid := signTestToken(t, map[string]interface{}{"iss": "example.com", "exp": exp})
+	tampered := strings.Split(valid, ".")
+	tampered[1] = encodeSegment(t, map[string]interface{}{"iss": "example.com", "exp": exp, "admin": true})
+
+	tests := []struct {
+		name          string
+		token         string
+		expectedStep  string
+		expectedError string
+	}{
+		{
+			name:  "valid",
+			token: valid,
+		},
+		{
+			name:          "not a JWT",
+			token:         "sfdjkfjk.sdsdads.asdasd",
+			expectedStep:  "parse",
+			expectedError: "invalid character",
+		},
+		{
+			name:          "missing exp",
+			token:         sign(jwt.SigningMethodRS256, key, jwt.MapClaims{"iss": "example.com"}),
+			expectedStep:  "exp",
+			expectedError: "token expired",
+		},
+		{
+			name:          "expired",
+			token:         signTestToken(t, map[string]interface{}{"iss": "example.com", "exp": now.Add(-time.Second).Unix()}),
+			expectedStep:  "exp",
+			expectedError: "token expired",
+		},
+		{
+			name:          "missing iss",
+			token:         signTestToken(t, map[string]interface{}{"exp": exp}),
+			expectedStep:  "iss",
+			expectedError: "iss not found",
+		},
+		{
+			name:          "iss is not a string",
+			token:         signTestToken(t, map[string]interface{}{"iss": 123, "exp": exp}),
+			expectedStep:  "iss",
+			expectedError: "iss was not in correct format",
+		},
+		{
+			name:          "unknown iss",
+			token:         signTestToken(t, map[string]interface{}{"iss": "example.org", "exp": exp}),
+			expectedStep:  "iss",
+			expectedError: "iss not valid",
+		},
+		{
+			name:          "unsigned",
+			token:         encodeSegment(t, map[string]interface{}{"alg": "none", "typ": "JWT"}) + "." + tampered[1] + ".",
+			expectedStep:  "alg",
+			expectedError: "token specified none",
+		},
+		{
+			name:          "signed with HMAC using the issuer's public key as the secret",
+			token:         sign(jwt.SigningMethodHS256, []byte(testKeys["example.com"]), jwt.MapClaims{"iss": "example.com", "exp": exp}),
+			expectedStep:  "alg",
+			expectedError: "token specified HS256",
+		},
+		{
+			name:          "signed with another key",
+			token:         sign(jwt.SigningMethodRS256, otherKey, jwt.MapClaims{"iss": "example.com", "exp": exp}),
+			expectedStep:  "signature",
+			expectedError: "verification error",
+		},
+		{
+			name:          "claims changed after signing",
+			token:         strings.Join(tampered, "."),
+			expectedStep:  "signature",
+			expectedError: "verification error",
+		},
+		{
+			name:          "issued in the future",
+			token:         signTestToken(t, map[string]interface{}{"iss": "example.com", "exp": exp, "iat": now.Add(time.Minute).Unix()}),
+			expectedStep:  "iat",
+			expectedError: "Token used before issued",
+		},
+		{
+			name:          "not valid yet",
+			token:         signTestToken(t, map[string]interface{}{"iss": "example.com", "exp": exp, "nbf": now.Add(time.Minute).Unix()}),
+			expectedStep:  "nbf",
+			expectedError: "Token is not valid yet",
+		},
+	}
+
+	h := NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys), Now: func() time.Time { return now }}, nil)
+	for _, test := range tests {
+		var failedStep string
+		claims, err := h.Validate(test.token, func(step string, err error, detail string) {
+			if err != nil {
+				failedStep = step
+			}
+		})
+		if test.expectedError == "" {
+			if err != nil || claims["iss"] != "example.com" {
+				t.Errorf("%s: expected the token to be valid, but got claims %v and error %v", test.name, claims, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("%s: expected error containing '%s', but got %v", test.name, test.expectedError, err)
+		}
+		if failedStep != test.expectedStep {
+			t.Errorf("%s: expected the %s step to fail, but got '%s'", test.name, test.expectedStep, failedStep)
+		}
+		if claims != nil {
+			t.Errorf("%s: expected no claims, but got %v", test.name, claims)
+		}
+	}
+}
+
+// encodeSegment encodes a JWT header or claims segment without signing it.
+func encodeSegment(t *testing.T, v map[string]interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	token := signTestToken(t, map[string]interface{}{"iss": "example.com"})
+	tests := []struct {
+		name               string
+		method             string
+		authorization      string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{
+			name:               "bearer",
+			authorization:      "Bearer " + token,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "the scheme is case insensitive",
+			authorization:      "bearer " + token,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "CORS preflight requests aren't authenticated",
+			method:             http.MethodOptions,
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "OK",
+		},
+		{
+			name:               "missing header",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "Required authorization token not found",
+		},
+		{
+			name:               "other schemes are rejected",
+			authorization:      "Basic dXNlcjpwYXNzd29yZA==",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "Authorization header format must be Bearer {token} or DPoP {token}",
+		},
+		{
+			name:               "scheme without a token",
+			authorization:      "Bearer",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "Authorization header format must be Bearer {token} or DPoP {token}",
+		},
+		{
+			name:               "extra fields",
+			authorization:      "Bearer " + token + " extra",
+			expectedStatusCode: http.StatusUnauthorized,
+			expectedBody:       "Authorization header format must be Bearer {token} or DPoP {token}",
+		},
+	}
+
+	for _, test := range tests {
+		handler := NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		method := test.method
+		if method == "" {
+			method = http.MethodGet
+		}
+		r := httptest.NewRequest(method, "/", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %d, but got %d", test.name, test.expectedStatusCode, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body to contain '%s', but got '%s'", test.name, test.expectedBody, w.Body.String())
+		}
+	}
+}
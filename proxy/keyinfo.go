@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// KeyInfo describes an issuer's key, without revealing the key itself.
+type KeyInfo struct {
+	Issuer string `json:"issuer"`
+	// KeyID is the "kid" that tokens use to select the key, if the key has one.
+	KeyID string `json:"kid"`
+	// Type is the key type and size, e.g. "RSA-2048" or "EC-P-256".
+	Type string `json:"type"`
+	// Algorithms are the signing algorithms that the key can be used to verify.
+	Algorithms []string `json:"algorithms"`
+	// Fingerprint is the SHA-256 hash of the DER encoded public key.
+	Fingerprint string `json:"fingerprint"`
+	// Subject and NotAfter are set if the key is a certificate.
+	Subject  string     `json:"subject,omitempty"`
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// KeyInventory describes the PEM encoded public keys of each issuer, in issuer order.
+func KeyInventory(keys map[string]string) []KeyInfo {
+	issuers := sortedKeys(keys)
+	inventory := make([]KeyInfo, len(issuers))
+	for i, issuer := range issuers {
+		inventory[i] = DescribeKey(issuer, keys[issuer])
+	}
+	return inventory
+}
+
+// DescribeKey describes an issuer's PEM encoded public key or certificate. If the key can't be used,
+// the Error is set.
+func DescribeKey(issuer, key string) KeyInfo {
+	k, err := ParseKey(issuer, key)
+	if err != nil {
+		return KeyInfo{Issuer: issuer, Error: err.Error()}
+	}
+	return k.Info()
+}
+
+// Info describes the key. If the key can't be used, the Error is set.
+func (k Key) Info() KeyInfo {
+	info := KeyInfo{Issuer: k.Issuer, KeyID: k.KeyID}
+	var der []byte
+	var err error
+	if len(k.Certificates) > 0 {
+		cert := k.Certificates[0]
+		der = cert.RawSubjectPublicKeyInfo
+		info.Subject = cert.Subject.String()
+		info.NotAfter = &cert.NotAfter
+	} else if der, err = x509.MarshalPKIXPublicKey(k.PublicKey); err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	sum := sha256.Sum256(der)
+	info.Fingerprint = "sha256:" + hex.EncodeToString(sum[:])
+	info.Type, info.Algorithms, err = KeyAlgorithms(k.PublicKey)
+	if err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
+
+// KeyAlgorithms returns the type of the public key, and the JWS algorithms that can be verified with it.
+func KeyAlgorithms(pub interface{}) (string, []string, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen()), []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}, nil
+	case *ecdsa.PublicKey:
+		name := k.Curve.Params().Name
+		switch name {
+		case "P-256":
+			return "EC-" + name, []string{"ES256"}, nil
+		case "P-384":
+			return "EC-" + name, []string{"ES384"}, nil
+		case "P-521":
+			return "EC-" + name, []string{"ES512"}, nil
+		}
+		return "EC-" + name, nil, fmt.Errorf("EC curve %s is not supported", name)
+	case ed25519.PublicKey:
+		return "Ed25519", []string{"EdDSA"}, nil
+	}
+	return "unknown", nil, fmt.Errorf("unsupported key type %T", pub)
+}
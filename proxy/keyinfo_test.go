@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyInventory(t *testing.T) {
+	inventory := KeyInventory(map[string]string{
+		"example.com": testKeys["example.com"],
+		"invalid.com": "not a key",
+	})
+
+	expected := []KeyInfo{
+		{
+			Issuer:      "example.com",
+			Type:        "RSA-2048",
+			Algorithms:  []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"},
+			Fingerprint: "sha256:9d344de7a23758c69cb734e1d34084efc7fe0fbaaab1c7ce68b94f3d6dc60d34",
+		},
+		{
+			Issuer: "invalid.com",
+			Error:  "key is not PEM encoded",
+		},
+	}
+	if !reflect.DeepEqual(inventory, expected) {
+		t.Errorf("expected inventory %+v, but got %+v", expected, inventory)
+	}
+}
+
+func TestDescribeCertificate(t *testing.T) {
+	chain, _ := testIssuerCertificate(t, time.Now().Add(time.Hour))
+	info := DescribeKey("example.com", chain)
+	if info.Error != "" {
+		t.Fatalf("unexpected error %s", info.Error)
+	}
+	// The fingerprint is of the public key, so it doesn't change when the certificate is renewed.
+	if expected := DescribeKey("example.com", testKeys["example.com"]).Fingerprint; info.Fingerprint != expected {
+		t.Errorf("expected fingerprint %s, but got %s", expected, info.Fingerprint)
+	}
+	if info.Subject != "CN=example.com" || info.NotAfter == nil {
+		t.Errorf("expected the certificate's subject and expiry, but got %+v", info)
+	}
+}
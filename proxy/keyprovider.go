@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+)
+
+// ErrKeyNotFound is returned by a KeyProvider which doesn't have a key for the issuer and key ID.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyProvider looks up the key used to verify a token. Implementations must be safe for concurrent use.
+type KeyProvider interface {
+	// Key returns the key of the issuer. kid is the token's "kid" header, which is empty if the token
+	// doesn't have one. If there's no matching key, ErrKeyNotFound is returned.
+	Key(issuer, kid string) (Key, error)
+}
+
+// KeyProviders looks up keys in each provider in turn, e.g. to combine the keys in a KeyStore with the
+// key sets of issuers which publish them.
+type KeyProviders []KeyProvider
+
+// Key returns the key from the first provider which has a key for the issuer.
+func (ps KeyProviders) Key(issuer, kid string) (Key, error) {
+	for _, p := range ps {
+		k, err := p.Key(issuer, kid)
+		if err != ErrKeyNotFound {
+			return k, err
+		}
+	}
+	return Key{}, ErrKeyNotFound
+}
+
+// Key is a public key used to verify the signature of an issuer's tokens.
+type Key struct {
+	Issuer string
+	// KeyID is the "kid" that tokens use to select the key, if the key has one.
+	KeyID string
+	// PublicKey is an *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+	PublicKey crypto.PublicKey
+	// Certificates are set if the key is a certificate, with the issuer's certificate first, followed by
+	// any intermediate certificates.
+	Certificates []*x509.Certificate
+}
+
+// ParseKey parses an issuer's PEM encoded public key or certificate.
+func ParseKey(issuer, key string) (Key, error) {
+	pub, err := parsePublicKey(key)
+	if err != nil {
+		return Key{}, err
+	}
+	certs, err := IssuerCertificates(key)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Issuer: issuer, PublicKey: pub, Certificates: certs}, nil
+}
+
+// FileKeyProvider provides the keys in a JSON file which maps each issuer to its key, e.g. keys.json.
+type FileKeyProvider struct {
+	*KeyStore
+	Path string
+}
+
+// NewFileKeyProvider creates a FileKeyProvider containing the keys in the file.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{KeyStore: NewKeyStore(nil), Path: path}
+	return p, p.Reload()
+}
+
+// Reload reads the file again. If it can't be read, the previous keys are kept.
+func (p *FileKeyProvider) Reload() error {
+	keys, err := ReadKeysFile(p.Path)
+	if err != nil {
+		return err
+	}
+	p.Set(keys)
+	return nil
+}
+
+// DirectoryKeyProvider provides the keys in a directory of key files, as read by ReadKeysDirectory.
+type DirectoryKeyProvider struct {
+	*KeyStore
+	Dir string
+}
+
+// NewDirectoryKeyProvider creates a DirectoryKeyProvider containing the keys in the directory.
+func NewDirectoryKeyProvider(dir string) (*DirectoryKeyProvider, error) {
+	p := &DirectoryKeyProvider{KeyStore: NewKeyStore(nil), Dir: dir}
+	return p, p.Reload()
+}
+
+// Reload reads the directory again. If it can't be read, the previous keys are kept.
+func (p *DirectoryKeyProvider) Reload() error {
+	keys, err := ReadKeysDirectory(p.Dir)
+	if err != nil {
+		return err
+	}
+	p.Set(keys)
+	return nil
+}
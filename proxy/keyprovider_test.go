@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+	write := func(keys interface{}) {
+		data, _ := json.Marshal(keys)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(testKeys)
+	p, err := NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if k, err := p.Key("example.com", "any"); err != nil || k.Issuer != "example.com" || k.PublicKey == nil {
+		t.Errorf("expected the key of example.com, but got %+v, %v", k, err)
+	}
+
+	write(map[string]string{"example.org": testKeys["example.com"]})
+	if err := p.Reload(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := p.Key("example.com", ""); err != ErrKeyNotFound {
+		t.Errorf("expected the removed issuer not to be found, but got %v", err)
+	}
+
+	write([]string{"not", "a", "map"})
+	if err := p.Reload(); err == nil {
+		t.Error("expected an error reloading an invalid file")
+	}
+	if _, err := p.Key("example.org", ""); err != nil {
+		t.Errorf("expected the previous keys to be kept, but got %v", err)
+	}
+}
+
+func TestDirectoryKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "example.com.pem"), []byte(testKeys["example.com"]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "invalid.com.pem"), []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewDirectoryKeyProvider(dir)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if k, err := p.Key("example.com", ""); err != nil || k.Info().Type != "RSA-2048" {
+		t.Errorf("expected the key of example.com, but got %+v, %v", k, err)
+	}
+	if _, err := p.Key("invalid.com", ""); err == nil || err.Error() != "key is not PEM encoded" {
+		t.Errorf("expected the key's parse error, but got %v", err)
+	}
+	if _, err := p.Key("example.org", ""); err != ErrKeyNotFound {
+		t.Errorf("expected an unknown issuer not to be found, but got %v", err)
+	}
+	if _, err := NewDirectoryKeyProvider(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestKeyProviders(t *testing.T) {
+	failing := NewJWKSKeyProvider(JWKSOptions{URLs: map[string]string{"example.org": "http://127.0.0.1:0/jwks.json"}})
+	p := KeyProviders{NewKeyStore(testKeys), failing}
+
+	if k, err := p.Key("example.com", ""); err != nil || k.Issuer != "example.com" {
+		t.Errorf("expected the key from the first provider, but got %+v, %v", k, err)
+	}
+	if _, err := p.Key("example.org", ""); err == nil || err == ErrKeyNotFound {
+		t.Errorf("expected the error of the second provider, but got %v", err)
+	}
+	if _, err := p.Key("unknown.com", ""); err != ErrKeyNotFound {
+		t.Errorf("expected an unknown issuer not to be found, but got %v", err)
+	}
+}
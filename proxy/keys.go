@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// NormalizePublicKey converts a public key or certificate which is base64 encoded, DER encoded or a JSON
+// Web Key into PEM. PEM encoded keys, and values which can't be decoded, are returned unchanged
+// so that the error is reported when the key is used.
+func NormalizePublicKey(value string) string {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "-----BEGIN") {
+		return value
+	}
+	if strings.HasPrefix(trimmed, "{") {
+		var jwk JSONWebKey
+		if err := json.Unmarshal([]byte(trimmed), &jwk); err != nil {
+			return value
+		}
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			return value
+		}
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return value
+		}
+		return encodePublicKey(der)
+	}
+	if key, ok := parseDER([]byte(value)); ok {
+		return key
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		decoded, err := enc.DecodeString(trimmed)
+		if err != nil {
+			continue
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(decoded), []byte("-----BEGIN")) {
+			return string(decoded)
+		}
+		if key, ok := parseDER(decoded); ok {
+			return key
+		}
+	}
+	return value
+}
+
+// parseDER converts a DER encoded public key or certificate to PEM.
+func parseDER(der []byte) (string, bool) {
+	if pub, ok := parseDERPublicKey(der); ok {
+		return encodePublicKey(pub), true
+	}
+	if _, err := x509.ParseCertificate(der); err == nil {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), true
+	}
+	return "", false
+}
+
+// parseDERPublicKey returns the PKIX encoding of a DER encoded PKIX or PKCS #1 public key.
+func parseDERPublicKey(der []byte) ([]byte, bool) {
+	if _, err := x509.ParsePKIXPublicKey(der); err == nil {
+		return der, true
+	}
+	pub, err := x509.ParsePKCS1PublicKey(der)
+	if err != nil {
+		return nil, false
+	}
+	der, err = x509.MarshalPKIXPublicKey(pub)
+	return der, err == nil
+}
+
+func encodePublicKey(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// parsePublicKey parses a PEM encoded public key or certificate.
+func parsePublicKey(key string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("key is not PEM encoded")
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// VerifySigningMethod checks that the token's signing method is one of the algorithms which can be
+// verified using the key. Without this check, a token could be signed with HS256 using the public key as
+// the secret.
+func VerifySigningMethod(method jwt.SigningMethod, pub crypto.PublicKey) error {
+	_, algorithms, err := KeyAlgorithms(pub)
+	if err != nil {
+		return err
+	}
+	for _, alg := range algorithms {
+		if method.Alg() == alg {
+			return nil
+		}
+	}
+	return fmt.Errorf("Expected %s signing method but token specified %s", strings.Join(algorithms, ", "), method.Alg())
+}
+
+// KeyStore holds the PEM encoded public key of each issuer. The keys can be replaced while the proxy is
+// running, e.g. when the key files are reloaded. The keys don't have IDs, so the token's kid is ignored.
+type KeyStore struct {
+	mu     sync.RWMutex
+	keys   map[string]string
+	parsed map[string]parsedKey
+}
+
+type parsedKey struct {
+	key Key
+	err error
+}
+
+// NewKeyStore creates a KeyStore containing the keys.
+func NewKeyStore(keys map[string]string) *KeyStore {
+	s := &KeyStore{}
+	s.Set(keys)
+	return s
+}
+
+// Key returns the key of the issuer. If the issuer's key can't be parsed, the parse error is returned.
+func (s *KeyStore) Key(issuer, kid string) (Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.parsed[issuer]
+	if !ok {
+		return Key{}, ErrKeyNotFound
+	}
+	return p.key, p.err
+}
+
+// Keys returns a copy of the keys.
+func (s *KeyStore) Keys() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyKeys(s.keys)
+}
+
+// Set replaces all of the keys.
+func (s *KeyStore) Set(keys map[string]string) {
+	keys = copyKeys(keys)
+	parsed := make(map[string]parsedKey, len(keys))
+	for issuer, key := range keys {
+		k, err := ParseKey(issuer, key)
+		parsed[issuer] = parsedKey{key: k, err: err}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys, s.parsed = keys, parsed
+}
+
+func copyKeys(keys map[string]string) map[string]string {
+	m := make(map[string]string, len(keys))
+	for k, v := range keys {
+		m[k] = v
+	}
+	return m
+}
+
+// keyFileExtensions are removed from the names of files in a keys directory to get the issuer, e.g.
+// "example.com.pem" contains the key of the "example.com" issuer.
+var keyFileExtensions = map[string]bool{
+	".pem":  true,
+	".pub":  true,
+	".key":  true,
+	".der":  true,
+	".jwk":  true,
+	".json": true,
+}
+
+// keyMetadataSuffix is the suffix of a key's sidecar metadata file, e.g. "partner.pem.meta.json". The
+// metadata file sets the issuer, for issuers which can't be used as a file name, such as URLs.
+const keyMetadataSuffix = ".meta.json"
+
+type keyMetadata struct {
+	Issuer string `json:"issuer"`
+}
+
+// ReadKeysDirectory reads every key file in the directory. Hidden files and directories are ignored, so
+// that Kubernetes secret volumes can be used.
+func ReadKeysDirectory(dir string) (map[string]string, error) {
+	keys := make(map[string]string)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return keys, fmt.Errorf("Failed to read directory %s with error %v", dir, err)
+	}
+	sources := make(map[string]string)
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, keyMetadataSuffix) {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		// Follow symbolic links, which ReadDir doesn't.
+		info, err := os.Stat(path)
+		if err != nil {
+			return keys, fmt.Errorf("Failed to read file %s with error %v", path, err)
+		}
+		if info.IsDir() {
+			continue
+		}
+		issuer, err := keyFileIssuer(path)
+		if err != nil {
+			return keys, err
+		}
+		if existing, ok := sources[issuer]; ok {
+			return keys, fmt.Errorf("issuer '%s' has keys in both %s and %s", issuer, existing, path)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return keys, fmt.Errorf("Failed to read file %s with error %v", path, err)
+		}
+		keys[issuer] = NormalizePublicKey(string(data))
+		sources[issuer] = path
+	}
+	return keys, nil
+}
+
+// ReadKeysFile reads a JSON file which maps each issuer to its key, e.g. keys.json.
+func ReadKeysFile(path string) (map[string]string, error) {
+	keys := make(map[string]string)
+	file, err := os.Open(path)
+	if err != nil {
+		return keys, fmt.Errorf("Failed to open file %s with error %v", path, err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return keys, fmt.Errorf("Failed to read file %s with error %v", path, err)
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return make(map[string]string), fmt.Errorf("Failed to parse JSON file %s with error %v", path, err)
+	}
+	for issuer, key := range keys {
+		keys[issuer] = NormalizePublicKey(key)
+	}
+	return keys, nil
+}
+
+// keyFileIssuer returns the issuer from the key file's metadata file, if it has one, otherwise from the
+// name of the file.
+func keyFileIssuer(path string) (string, error) {
+	data, err := ioutil.ReadFile(path + keyMetadataSuffix)
+	if os.IsNotExist(err) {
+		name := filepath.Base(path)
+		if ext := filepath.Ext(name); keyFileExtensions[strings.ToLower(ext)] {
+			name = strings.TrimSuffix(name, ext)
+		}
+		return name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to read file %s with error %v", path+keyMetadataSuffix, err)
+	}
+	var m keyMetadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", fmt.Errorf("Failed to parse JSON file %s with error %v", path+keyMetadataSuffix, err)
+	}
+	if m.Issuer == "" {
+		return "", fmt.Errorf("issuer not found in %s", path+keyMetadataSuffix)
+	}
+	return m.Issuer, nil
+}
+
+// IssuerCertificates returns the certificates in a PEM encoded key, with the issuer's certificate first,
+// followed by any intermediate certificates. If the key is a public key rather than a certificate, no
+// certificates are returned.
+func IssuerCertificates(key string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(key)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// VerifyIssuerCertificates checks that the certificates of issuers whose key is a certificate can be
+// parsed, and if roots are given, that they were issued by one of the roots. Expired certificates are
+// checked as at their expiry time, since expiry is handled separately.
+func VerifyIssuerCertificates(keys map[string]string, roots *x509.CertPool, now time.Time) error {
+	for _, issuer := range sortedKeys(keys) {
+		certs, err := IssuerCertificates(keys[issuer])
+		if err != nil {
+			return fmt.Errorf("failed to parse the certificate of issuer '%s' with error %v", issuer, err)
+		}
+		if len(certs) == 0 || roots == nil {
+			continue
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		at := now
+		if at.After(certs[0].NotAfter) {
+			at = certs[0].NotAfter
+		}
+		_, err = certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   at,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return fmt.Errorf("the certificate of issuer '%s' is not trusted: %v", issuer, err)
+		}
+	}
+	return nil
+}
+
+// ReportIssuerCertificates records the expiry time of each issuer's certificate, and warns about
+// certificates which have expired, or will expire within the warning period.
+func ReportIssuerCertificates(w io.Writer, metrics *Metrics, keys map[string]string, now time.Time, warnBefore time.Duration, allowExpired bool) {
+	expiry := make(map[string]time.Time)
+	for _, issuer := range sortedKeys(keys) {
+		certs, err := IssuerCertificates(keys[issuer])
+		if err != nil || len(certs) == 0 {
+			continue
+		}
+		notAfter := certs[0].NotAfter
+		expiry[issuer] = notAfter
+		switch {
+		case now.After(notAfter) && allowExpired:
+			fmt.Fprintf(w, "WARNING: the certificate of issuer '%s' expired at %s\n", issuer, notAfter.Format(time.RFC3339))
+		case now.After(notAfter):
+			fmt.Fprintf(w, "WARNING: the certificate of issuer '%s' expired at %s, tokens from the issuer will be rejected\n", issuer, notAfter.Format(time.RFC3339))
+		case now.Add(warnBefore).After(notAfter):
+			fmt.Fprintf(w, "WARNING: the certificate of issuer '%s' expires at %s\n", issuer, notAfter.Format(time.RFC3339))
+		}
+	}
+	metrics.IssuerCertificatesLoaded(expiry)
+}
@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReadKeysDirectory(t *testing.T) {
+	block, _ := pem.Decode([]byte(testKeys["example.com"]))
+
+	tests := []struct {
+		name          string
+		files         map[string]string
+		expected      map[string]string
+		expectedError string
+	}{
+		{
+			name: "issuers are named after the files",
+			files: map[string]string{
+				"example.com.pem": testKeys["example.com"],
+				"example.org.der": string(block.Bytes),
+				"example.net":     "key",
+				".hidden.pem":     "hidden",
+				"subdir/a.pem":    "ignored",
+			},
+			expected: map[string]string{
+				"example.com": testKeys["example.com"],
+				"example.org": string(pem.EncodeToMemory(block)),
+				"example.net": "key",
+			},
+		},
+		{
+			name: "issuers are read from metadata files",
+			files: map[string]string{
+				"partner.pem":           testKeys["example.com"],
+				"partner.pem.meta.json": `{"issuer": "https://partner.example.com/"}`,
+			},
+			expected: map[string]string{
+				"https://partner.example.com/": testKeys["example.com"],
+			},
+		},
+		{
+			name: "metadata files must contain an issuer",
+			files: map[string]string{
+				"partner.pem":           testKeys["example.com"],
+				"partner.pem.meta.json": `{}`,
+			},
+			expectedError: "issuer not found",
+		},
+		{
+			name: "issuers can only have one key",
+			files: map[string]string{
+				"example.com.pem": testKeys["example.com"],
+				"example.com.jwk": "key",
+			},
+			expectedError: "issuer 'example.com' has keys in both",
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "jwtproxy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for name, content := range test.files {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		actual, err := ReadKeysDirectory(dir)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected error containing '%s', but got %v", test.name, test.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected keys %v, but got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestKeyStoreReload(t *testing.T) {
+	store := NewKeyStore(map[string]string{})
+	handler := NewJWTAuthHandler(JWTAuthOptions{Keys: store}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	token := signTestToken(t, map[string]interface{}{"iss": "example.com"})
+
+	for _, test := range []struct {
+		name               string
+		keys               map[string]string
+		expectedStatusCode int
+	}{
+		{name: "unknown issuer", keys: map[string]string{}, expectedStatusCode: http.StatusUnauthorized},
+		{name: "reloaded issuer", keys: testKeys, expectedStatusCode: http.StatusOK},
+		{name: "removed issuer", keys: map[string]string{}, expectedStatusCode: http.StatusUnauthorized},
+	} {
+		store.Set(test.keys)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %d, but got %d", test.name, test.expectedStatusCode, w.Code)
+		}
+	}
+}
+
+// testIssuerCertificate returns a PEM encoded certificate for the example.com issuer's key, issued by a new
+// CA, followed by the CA's certificate.
+func testIssuerCertificate(t *testing.T, notAfter time.Time) (chain string, ca *x509.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-48 * time.Hour),
+		NotAfter:              time.Now().Add(48 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	ca, _ = x509.ParseCertificate(caDER)
+
+	block, _ := pem.Decode([]byte(testKeys["example.com"]))
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, pub, caKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	chain = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+	return chain, ca
+}
+
+func TestVerifyIssuerCertificates(t *testing.T) {
+	valid, ca := testIssuerCertificate(t, time.Now().Add(time.Hour))
+	expired, expiredCA := testIssuerCertificate(t, time.Now().Add(-time.Hour))
+	_, otherCA := testIssuerCertificate(t, time.Now().Add(time.Hour))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	roots.AddCert(expiredCA)
+	otherRoots := x509.NewCertPool()
+	otherRoots.AddCert(otherCA)
+
+	tests := []struct {
+		name          string
+		keys          map[string]string
+		roots         *x509.CertPool
+		expectedError string
+	}{
+		{
+			name: "certificates are accepted without a CA",
+			keys: map[string]string{"example.com": valid},
+		},
+		{
+			name:  "trusted certificates are accepted",
+			keys:  map[string]string{"example.com": valid, "example.org": testKeys["example.com"]},
+			roots: roots,
+		},
+		{
+			name:  "expired certificates are checked as at their expiry",
+			keys:  map[string]string{"example.com": expired},
+			roots: roots,
+		},
+		{
+			name:          "untrusted certificates are rejected",
+			keys:          map[string]string{"example.com": valid},
+			roots:         otherRoots,
+			expectedError: "the certificate of issuer 'example.com' is not trusted",
+		},
+		{
+			name:          "invalid certificates are rejected",
+			keys:          map[string]string{"example.com": "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"},
+			expectedError: "failed to parse the certificate of issuer 'example.com'",
+		},
+	}
+
+	for _, test := range tests {
+		err := VerifyIssuerCertificates(test.keys, test.roots, time.Now())
+		if test.expectedError == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+			t.Errorf("%s: expected error containing '%s', but got %v", test.name, test.expectedError, err)
+		}
+	}
+}
+
+func TestIssuerCertificateExpiry(t *testing.T) {
+	valid, _ := testIssuerCertificate(t, time.Now().Add(time.Hour))
+	expired, _ := testIssuerCertificate(t, time.Now().Add(-time.Hour))
+	token := signTestToken(t, map[string]interface{}{"iss": "example.com"})
+
+	tests := []struct {
+		name               string
+		key                string
+		allowExpired       bool
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{name: "valid certificate", key: valid, expectedStatusCode: http.StatusOK},
+		{name: "expired certificate", key: expired, expectedStatusCode: http.StatusUnauthorized, expectedBody: "issuer certificate expired"},
+		{name: "expired certificate allowed", key: expired, allowExpired: true, expectedStatusCode: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		handler := NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(map[string]string{"example.com": test.key})}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		}))
+		handler.AllowExpiredCertificates = test.allowExpired
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %d, but got %d", test.name, test.expectedStatusCode, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body to contain '%s', but got '%s'", test.name, test.expectedBody, w.Body.String())
+		}
+	}
+}
+
+func TestReportIssuerCertificates(t *testing.T) {
+	expiring, _ := testIssuerCertificate(t, time.Now().Add(time.Hour))
+	expired, _ := testIssuerCertificate(t, time.Now().Add(-time.Hour))
+	later, _ := testIssuerCertificate(t, time.Now().Add(47*time.Hour))
+	keys := map[string]string{
+		"expiring.com": expiring,
+		"expired.com":  expired,
+		"later.com":    later,
+		"example.com":  testKeys["example.com"],
+	}
+	metrics := NewMetrics()
+	var log bytes.Buffer
+
+	ReportIssuerCertificates(&log, metrics, keys, time.Now(), 24*time.Hour, false)
+
+	for _, expected := range []string{
+		"WARNING: the certificate of issuer 'expired.com' expired at",
+		"tokens from the issuer will be rejected",
+		"WARNING: the certificate of issuer 'expiring.com' expires at",
+	} {
+		if !strings.Contains(log.String(), expected) {
+			t.Errorf("expected log to contain '%s', but got '%s'", expected, log.String())
+		}
+	}
+	if strings.Contains(log.String(), "later.com") {
+		t.Errorf("expected no warning for later.com, but got '%s'", log.String())
+	}
+	if n := testutil.CollectAndCount(metrics.IssuerCertificateExpiry); n != 3 {
+		t.Errorf("expected the expiry of 3 certificates to be recorded, but got %d", n)
+	}
+}
+
+func TestSigningMethodMustMatchIssuerKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewKeyStore(map[string]string{"example.com": encodePublicKey(der)})
+	handler := NewJWTAuthHandler(JWTAuthOptions{Keys: keys}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+signTestToken(t, map[string]interface{}{"iss": "example.com"}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "Expected ES256 signing method but token specified RS256") {
+		t.Errorf("expected an RS256 token to be rejected for an EC key, but got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// errBodyTooLarge is returned when more of a request body is read than the BodyLimitHandler allows.
+var errBodyTooLarge = errors.New("request body too large")
+
+// BodyLimitHandler rejects requests whose body is larger than MaxBytes with 413 Request Entity Too Large.
+// Requests which declare their length are rejected before they're proxied. Requests which don't are
+// proxied until the limit is reached, then the request to the remote host is abandoned.
+type BodyLimitHandler struct {
+	MaxBytes int64
+	Next     http.Handler
+}
+
+// NewBodyLimitHandler creates a handler which limits the size of request bodies. If maxBytes is zero,
+// the size isn't limited.
+func NewBodyLimitHandler(maxBytes int64, next http.Handler) BodyLimitHandler {
+	return BodyLimitHandler{
+		MaxBytes: maxBytes,
+		Next:     next,
+	}
+}
+
+func (h BodyLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.MaxBytes <= 0 {
+		h.Next.ServeHTTP(w, r)
+		return
+	}
+	if r.ContentLength > h.MaxBytes {
+		httpError(w, r, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &limitedBody{ReadCloser: r.Body, remaining: h.MaxBytes}
+	}
+	h.Next.ServeHTTP(w, r)
+}
+
+// limitedBody returns errBodyTooLarge once more than the remaining bytes have been read. Unlike
+// http.MaxBytesReader, the error can be recognised when the reverse proxy fails to send the body.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n, b.remaining, b.exceeded = int(b.remaining), 0, true
+	return n, errBodyTooLarge
+}
+
+// LimitListener returns a listener which accepts at most n connections at once. Further connections
+// wait to be accepted until an open connection is closed.
+func LimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitListenerConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
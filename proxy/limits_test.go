@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyLimitHandler(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	handler := NewBodyLimitHandler(10, NewReverseProxy(ReverseProxyOptions{Target: upstreamURL}))
+
+	tests := []struct {
+		name               string
+		body               string
+		unknownLength      bool
+		expectedStatusCode int
+		expectedReceived   string
+	}{
+		{
+			name:               "body within the limit",
+			body:               "0123456789",
+			expectedStatusCode: http.StatusOK,
+			expectedReceived:   "0123456789",
+		},
+		{
+			name:               "body of unknown length within the limit",
+			body:               "0123456789",
+			unknownLength:      true,
+			expectedStatusCode: http.StatusOK,
+			expectedReceived:   "0123456789",
+		},
+		{
+			name:               "body over the limit",
+			body:               "0123456789a",
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:               "body of unknown length over the limit",
+			body:               strings.Repeat("a", 1024*1024),
+			unknownLength:      true,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, test := range tests {
+		received = ""
+		r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		if test.unknownLength {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %d, but got %d: %s", test.name, test.expectedStatusCode, w.Code, w.Body.String())
+		}
+		if test.expectedReceived != "" && received != test.expectedReceived {
+			t.Errorf("%s: expected the remote host to receive '%s', but got '%s'", test.name, test.expectedReceived, received)
+		}
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := LimitListener(l, 1)
+	defer limited.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("expected the second connection to wait until the first is closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case second := <-accepted:
+		second.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the second connection to be accepted once the first was closed")
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// LogFormatter writes an access log entry to w.
+type LogFormatter func(w io.Writer, e AccessLogEntry) error
+
+// NewLogFormatter creates a LogFormatter for the named format: "json" (the default), "logfmt", "common"
+// (Common Log Format) or "combined" (Combined Log Format). Any other value containing "{{" is used as a
+// text/template over the fields of the AccessLogEntry, e.g. "{{.Method}} {{.URL}} {{.Status}}".
+func NewLogFormatter(format string) (LogFormatter, error) {
+	switch format {
+	case "", "json":
+		return formatJSON, nil
+	case "logfmt":
+		return formatLogfmt, nil
+	case "common":
+		return formatCommon, nil
+	case "combined":
+		return formatCombined, nil
+	}
+	if !strings.Contains(format, "{{") {
+		return nil, fmt.Errorf("invalid log format '%s', expected one of 'json', 'logfmt', 'common', 'combined' or a template", format)
+	}
+	t, err := template.New("log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse log format template with error %v", err)
+	}
+	newline := !strings.HasSuffix(format, "\n")
+	return func(w io.Writer, e AccessLogEntry) error {
+		if err := t.Execute(w, e); err != nil {
+			return err
+		}
+		if newline {
+			_, err := io.WriteString(w, "\n")
+			return err
+		}
+		return nil
+	}, nil
+}
+
+func formatJSON(w io.Writer, e AccessLogEntry) error {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bytes, '\n'))
+	return err
+}
+
+type logfmtField struct {
+	key   string
+	value string
+}
+
+func formatLogfmt(w io.Writer, e AccessLogEntry) error {
+	fields := []logfmtField{
+		{"date", e.Date.Format(time.RFC3339Nano)},
+		{"request_id", e.RequestID},
+		{"remote_address", e.RemoteAddress},
+		{"forwarded_for", e.ForwardedFor},
+		{"user_agent", e.UserAgent},
+		{"method", e.Method},
+		{"url", e.URL},
+		{"protocol", e.Protocol},
+		{"referer", e.Referer},
+		{"status", strconv.Itoa(e.Status)},
+		{"duration_ms", strconv.FormatFloat(e.DurationMS, 'f', -1, 64)},
+		{"bytes_in", strconv.FormatInt(e.BytesIn, 10)},
+		{"bytes_out", strconv.FormatInt(e.BytesOut, 10)},
+		{"upstream", e.Upstream},
+		{"auth_issuer", e.AuthIssuer},
+		{"auth_subject", e.AuthSubject},
+		{"auth_error", e.AuthError},
+	}
+	if e.AuthKeyID != "" {
+		fields = append(fields, logfmtField{"auth_key_id", e.AuthKeyID})
+	}
+	if e.AuthExpiry != nil {
+		fields = append(fields, logfmtField{"auth_expiry", e.AuthExpiry.Format(time.RFC3339)})
+	}
+	for _, name := range sortedKeys(e.Headers) {
+		fields = append(fields, logfmtField{"header." + name, e.Headers[name]})
+	}
+	claims := make(map[string]string, len(e.Claims))
+	for name, value := range e.Claims {
+		claims[name] = claimString(value)
+	}
+	for _, name := range sortedKeys(claims) {
+		fields = append(fields, logfmtField{"claim." + name, claims[name]})
+	}
+	var sb strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(f.key)
+		sb.WriteByte('=')
+		sb.WriteString(logfmtValue(f.value))
+	}
+	sb.WriteByte('\n')
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\") || strings.IndexFunc(v, func(r rune) bool { return r < ' ' }) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+func formatCommon(w io.Writer, e AccessLogEntry) error {
+	_, err := io.WriteString(w, commonLogFormat(e)+"\n")
+	return err
+}
+
+func formatCombined(w io.Writer, e AccessLogEntry) error {
+	_, err := fmt.Fprintf(w, "%s \"%s\" \"%s\"\n", commonLogFormat(e), clfEscape(e.Referer), clfEscape(e.UserAgent))
+	return err
+}
+
+// commonLogFormat formats the entry as "host ident authuser [date] "request" status bytes".
+func commonLogFormat(e AccessLogEntry) string {
+	host := e.RemoteAddress
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	bytes := "-"
+	if e.BytesOut > 0 {
+		bytes = strconv.FormatInt(e.BytesOut, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		clfValue(host),
+		clfValue(e.AuthSubject),
+		e.Date.Format("02/Jan/2006:15:04:05 -0700"),
+		clfEscape(e.Method), clfEscape(e.URL), clfEscape(e.Protocol),
+		e.Status,
+		bytes)
+}
+
+func clfValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.Replace(clfEscape(v), " ", "_", -1)
+}
+
+// clfEscape escapes quotes and control characters, so that values can't break the log format.
+func clfEscape(v string) string {
+	quoted := strconv.Quote(v)
+	return quoted[1 : len(quoted)-1]
+}
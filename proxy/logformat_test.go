@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFormats(t *testing.T) {
+	entry := AccessLogEntry{
+		Date:          time.Date(2000, 1, 2, 3, 4, 5, 0, time.UTC),
+		RequestID:     "a1b2c3",
+		RemoteAddress: "127.0.0.1:1234",
+		UserAgent:     "curl/7.54.0",
+		Method:        "GET",
+		URL:           "/api/user?id=1",
+		Protocol:      "HTTP/1.1",
+		Referer:       "http://example.com/",
+		Status:        200,
+		DurationMS:    1.5,
+		BytesOut:      512,
+		Upstream:      "10.0.0.1:8080",
+		AuthIssuer:    "example.com",
+		AuthSubject:   "user 1",
+	}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format:   "json",
+			expected: `{"Date":"2000-01-02T03:04:05Z","RequestID":"a1b2c3","RemoteAddress":"127.0.0.1:1234","ForwardedFor":"","UserAgent":"curl/7.54.0","Method":"GET","URL":"/api/user?id=1","Protocol":"HTTP/1.1","Referer":"http://example.com/","Status":200,"DurationMS":1.5,"BytesIn":0,"BytesOut":512,"Upstream":"10.0.0.1:8080","AuthIssuer":"example.com","AuthSubject":"user 1","AuthError":""}` + "\n",
+		},
+		{
+			format:   "logfmt",
+			expected: `date=2000-01-02T03:04:05Z request_id=a1b2c3 remote_address=127.0.0.1:1234 forwarded_for="" user_agent=curl/7.54.0 method=GET url="/api/user?id=1" protocol=HTTP/1.1 referer=http://example.com/ status=200 duration_ms=1.5 bytes_in=0 bytes_out=512 upstream=10.0.0.1:8080 auth_issuer=example.com auth_subject="user 1" auth_error=""` + "\n",
+		},
+		{
+			format:   "common",
+			expected: `127.0.0.1 - user_1 [02/Jan/2000:03:04:05 +0000] "GET /api/user?id=1 HTTP/1.1" 200 512` + "\n",
+		},
+		{
+			format:   "combined",
+			expected: `127.0.0.1 - user_1 [02/Jan/2000:03:04:05 +0000] "GET /api/user?id=1 HTTP/1.1" 200 512 "http://example.com/" "curl/7.54.0"` + "\n",
+		},
+		{
+			format:   "{{.RequestID}} {{.Method}} {{.URL}} {{.Status}} {{.AuthIssuer}}",
+			expected: "a1b2c3 GET /api/user?id=1 200 example.com\n",
+		},
+	}
+
+	for _, test := range tests {
+		formatter, err := NewLogFormatter(test.format)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.format, err)
+		}
+		actual := new(bytes.Buffer)
+		if err := formatter(actual, entry); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.format, err)
+		}
+		if actual.String() != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.format, test.expected, actual.String())
+		}
+	}
+
+	expiry := time.Date(2000, 1, 2, 4, 4, 5, 0, time.UTC)
+	entry.AuthKeyID, entry.AuthExpiry = "2024-01", &expiry
+	actual := new(bytes.Buffer)
+	formatLogfmt(actual, entry)
+	if expected := `auth_error="" auth_key_id=2024-01 auth_expiry=2000-01-02T04:04:05Z` + "\n"; !strings.HasSuffix(actual.String(), expected) {
+		t.Errorf("logfmt: expected the token's kid and expiry '%s', got '%s'", expected, actual.String())
+	}
+
+	if _, err := NewLogFormatter("xml"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
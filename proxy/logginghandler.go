@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// NewLoggingHandler creates a handler which prints to stdout.
+func NewLoggingHandler(next http.Handler) LoggingHandler {
+	return LoggingHandler{
+		Next:   next,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		Now:    time.Now,
+	}
+}
+
+// LoggingHandler logs the incoming requests to stdout, once the response has been written.
+type LoggingHandler struct {
+	Next   http.Handler
+	Stdout io.Writer
+	Stderr io.Writer
+	Now    clock
+	// Format writes the log entry, defaults to JSON.
+	Format LogFormatter
+	// Headers and Claims are the names of the request headers and JWT claims to include in the log.
+	Headers []string
+	Claims  []string
+	// Redactions are applied to the logged headers, claims and URL query string. Credentials such as the
+	// Authorization header are always dropped unless a different redaction is configured for them.
+	Redactions RedactionRules
+}
+
+type clock func() time.Time
+
+// AccessLogEntry is written to the log for each request.
+type AccessLogEntry struct {
+	Date          time.Time
+	RequestID     string
+	RemoteAddress string
+	ForwardedFor  string
+	UserAgent     string
+	Method        string
+	URL           string
+	Protocol      string
+	Referer       string
+	Status        int
+	DurationMS    float64
+	BytesIn       int64
+	BytesOut      int64
+	Upstream      string
+	AuthIssuer    string
+	AuthSubject   string
+	AuthKeyID     string     `json:",omitempty"`
+	AuthExpiry    *time.Time `json:",omitempty"`
+	AuthError     string
+	Headers       map[string]string      `json:",omitempty"`
+	Claims        map[string]interface{} `json:",omitempty"`
+}
+
+// RequestLog collects details about a request from the handlers which process it, for inclusion in the
+// access log.
+type RequestLog struct {
+	// Route is the name of the route which handled the request, e.g. "health". Empty for proxied requests.
+	Route string
+	// Upstream is the address of the remote host that the request was proxied to.
+	Upstream string
+	// UpstreamError is set to "timeout" or "error" if the request couldn't be proxied.
+	UpstreamError string
+	// AuthIssuer and AuthSubject identify the authenticated caller.
+	AuthIssuer  string
+	AuthSubject string
+	// AuthError is the reason that authentication failed.
+	AuthError string
+	// Token is the authenticated caller's JWT, if the caller was authenticated by a JWTAuthHandler.
+	Token *VerifiedToken
+}
+
+const requestLogKey = contextKey("requestLog")
+
+// requestLogFromContext returns the RequestLog of the request being logged, or nil if the request is not
+// being logged.
+func requestLogFromContext(ctx context.Context) *RequestLog {
+	l, _ := ctx.Value(requestLogKey).(*RequestLog)
+	return l
+}
+
+// withRequestLog adds a RequestLog to the request's context, unless it already has one.
+func withRequestLog(r *http.Request) (*http.Request, *RequestLog) {
+	if l := requestLogFromContext(r.Context()); l != nil {
+		return r, l
+	}
+	l := &RequestLog{}
+	return r.WithContext(context.WithValue(r.Context(), requestLogKey, l)), l
+}
+
+// recordRoute records the name of the route which handled the request.
+func recordRoute(r *http.Request, route string) {
+	if l := requestLogFromContext(r.Context()); l != nil {
+		l.Route = route
+	}
+}
+
+// recordAuthentication records the authenticated caller in the access log.
+func recordAuthentication(r *http.Request, issuer, subject string) {
+	if l := requestLogFromContext(r.Context()); l != nil {
+		l.AuthIssuer = issuer
+		l.AuthSubject = subject
+	}
+}
+
+// recordToken records the caller authenticated by a JWT in the access log.
+func recordToken(r *http.Request, t VerifiedToken) {
+	if l := requestLogFromContext(r.Context()); l != nil {
+		l.AuthIssuer = t.Issuer
+		l.AuthSubject = t.Subject
+		l.Token = &t
+	}
+}
+
+// recordAuthenticationFailure records the reason that authentication failed in the access log.
+func recordAuthenticationFailure(r *http.Request, reason string) {
+	if l := requestLogFromContext(r.Context()); l != nil {
+		l.AuthError = reason
+	}
+}
+
+func (lh LoggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := lh.Now()
+	requestLog := &RequestLog{}
+	r = r.WithContext(context.WithValue(r.Context(), requestLogKey, requestLog))
+	body := &countingReader{ReadCloser: r.Body}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = body
+	}
+	// Take a copy of the URL, since later handlers may rewrite it.
+	url := lh.Redactions.url(r.URL)
+	rw := &responseRecorder{ResponseWriter: w}
+
+	lh.Next.ServeHTTP(rw, r)
+
+	id, _ := requestIDFromContext(r.Context())
+	logEntry := AccessLogEntry{
+		Date:          start,
+		RequestID:     id.Value,
+		RemoteAddress: r.RemoteAddr,
+		ForwardedFor:  r.Header.Get("X-Forwarded-For"),
+		UserAgent:     r.UserAgent(),
+		Method:        r.Method,
+		URL:           url,
+		Protocol:      r.Proto,
+		Referer:       r.Referer(),
+		Status:        rw.status(),
+		DurationMS:    float64(lh.Now().Sub(start)) / float64(time.Millisecond),
+		BytesIn:       body.n,
+		BytesOut:      rw.n,
+		Upstream:      requestLog.Upstream,
+		AuthIssuer:    requestLog.AuthIssuer,
+		AuthSubject:   requestLog.AuthSubject,
+		AuthError:     requestLog.AuthError,
+		Headers:       lh.Redactions.headers(r.Header, lh.Headers),
+	}
+	if t := requestLog.Token; t != nil {
+		logEntry.AuthKeyID = t.KeyID
+		logEntry.AuthExpiry = &t.Expiry
+		logEntry.Claims = lh.Redactions.claims(t.Claims, lh.Claims)
+	}
+	format := lh.Format
+	if format == nil {
+		format = formatJSON
+	}
+	if err := format(lh.Stdout, logEntry); err != nil {
+		lh.Stderr.Write([]byte(err.Error()))
+		lh.Stderr.Write([]byte("\n"))
+	}
+}
+
+// responseRecorder records the status code and number of bytes written to a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	if rw.code == 0 {
+		rw.code = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(p []byte) (int, error) {
+	if rw.code == 0 {
+		rw.code = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	rw.n += int64(n)
+	return n, err
+}
+
+// Flush allows streamed responses to be flushed through the recorder.
+func (rw *responseRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows a http.ResponseController to access the underlying ResponseWriter.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *responseRecorder) status() int {
+	if rw.code == 0 {
+		return http.StatusOK
+	}
+	return rw.code
+}
+
+// countingReader counts the number of bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
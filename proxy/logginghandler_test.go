@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogging(t *testing.T) {
+	tests := []struct {
+		request            *http.Request
+		userAgent          string
+		forwardedFor       string
+		expectedLogMessage string
+	}{
+		{
+			request:            httptest.NewRequest("GET", "http://example.com/", nil),
+			userAgent:          "User-Agent-Value",
+			forwardedFor:       "X-Forwarded-For-Value",
+			expectedLogMessage: `{"Date":"2000-01-01T00:00:00Z","RequestID":"","RemoteAddress":"127.0.0.1","ForwardedFor":"X-Forwarded-For-Value","UserAgent":"User-Agent-Value","Method":"GET","URL":"http://example.com/","Protocol":"HTTP/1.1","Referer":"","Status":200,"DurationMS":0,"BytesIn":0,"BytesOut":0,"Upstream":"","AuthIssuer":"","AuthSubject":"","AuthError":""}` + "\n",
+		},
+		{
+			request:            httptest.NewRequest("GET", "http://example.com/?test=1", nil),
+			userAgent:          "",
+			forwardedFor:       "",
+			expectedLogMessage: `{"Date":"2000-01-01T00:00:00Z","RequestID":"","RemoteAddress":"127.0.0.1","ForwardedFor":"","UserAgent":"","Method":"GET","URL":"http://example.com/?test=1","Protocol":"HTTP/1.1","Referer":"","Status":200,"DurationMS":0,"BytesIn":0,"BytesOut":0,"Upstream":"","AuthIssuer":"","AuthSubject":"","AuthError":""}` + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		nextCalled := false
+		stdout := new(bytes.Buffer)
+		stderr := new(bytes.Buffer)
+
+		test.request.Header.Add("X-Forwarded-For", test.forwardedFor)
+		test.request.Header.Add("User-Agent", test.userAgent)
+		test.request.RemoteAddr = "127.0.0.1"
+
+		h := LoggingHandler{
+			Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextCalled = true
+			}),
+			Stdout: stdout,
+			Stderr: stderr,
+			Now:    func() time.Time { return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC) },
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, test.request)
+
+		if !nextCalled {
+			t.Errorf("Expected the next handler in the chain to be called.")
+		}
+
+		if stdout.String() != test.expectedLogMessage {
+			t.Errorf("Expected log message '%v', but got '%v'", test.expectedLogMessage, stdout.String())
+		}
+
+		if stderr.String() != "" {
+			t.Errorf("An unexpected message was written to stderr: %v", stderr.String())
+		}
+	}
+}
+
+func TestLoggingAfterCompletion(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Created"))
+	}))
+	defer remote.Close()
+	remoteURL, _ := url.Parse(remote.URL)
+
+	tests := []struct {
+		name          string
+		authorization string
+		expected      AccessLogEntry
+	}{
+		{
+			name:          "authenticated request",
+			authorization: "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com", "sub": "user-1"}),
+			expected: AccessLogEntry{
+				Status:      http.StatusCreated,
+				DurationMS:  1500,
+				BytesIn:     4,
+				BytesOut:    7,
+				Upstream:    remoteURL.Host,
+				AuthIssuer:  "example.com",
+				AuthSubject: "user-1",
+			},
+		},
+		{
+			name: "authentication failure",
+			expected: AccessLogEntry{
+				Status:     http.StatusUnauthorized,
+				DurationMS: 1500,
+				BytesOut:   int64(len("Required authorization token not found\n")),
+				AuthError:  "Required authorization token not found",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		stdout := new(bytes.Buffer)
+		times := []time.Time{
+			time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2000, 1, 1, 0, 0, 1, 500000000, time.UTC),
+		}
+		h := LoggingHandler{
+			Next:   NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, NewReverseProxy(ReverseProxyOptions{Target: remoteURL})),
+			Stdout: stdout,
+			Stderr: new(bytes.Buffer),
+			Now: func() time.Time {
+				now := times[0]
+				times = times[1:]
+				return now
+			},
+		}
+
+		r := httptest.NewRequest("POST", "http://example.com/", strings.NewReader("body"))
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		var actual AccessLogEntry
+		if err := json.Unmarshal(stdout.Bytes(), &actual); err != nil {
+			t.Fatalf("%s: failed to parse log entry '%s': %v", test.name, stdout.String(), err)
+		}
+		if actual.Status != test.expected.Status {
+			t.Errorf("%s: expected status %v, got %v", test.name, test.expected.Status, actual.Status)
+		}
+		if actual.DurationMS != test.expected.DurationMS {
+			t.Errorf("%s: expected duration %v, got %v", test.name, test.expected.DurationMS, actual.DurationMS)
+		}
+		if actual.BytesIn != test.expected.BytesIn {
+			t.Errorf("%s: expected %d bytes in, got %d", test.name, test.expected.BytesIn, actual.BytesIn)
+		}
+		if actual.BytesOut != test.expected.BytesOut {
+			t.Errorf("%s: expected %d bytes out, got %d", test.name, test.expected.BytesOut, actual.BytesOut)
+		}
+		if actual.Upstream != test.expected.Upstream {
+			t.Errorf("%s: expected upstream '%s', got '%s'", test.name, test.expected.Upstream, actual.Upstream)
+		}
+		if actual.AuthIssuer != test.expected.AuthIssuer || actual.AuthSubject != test.expected.AuthSubject {
+			t.Errorf("%s: expected issuer '%s' and subject '%s', got '%s' and '%s'", test.name,
+				test.expected.AuthIssuer, test.expected.AuthSubject, actual.AuthIssuer, actual.AuthSubject)
+		}
+		if actual.AuthError != test.expected.AuthError {
+			t.Errorf("%s: expected auth error '%s', got '%s'", test.name, test.expected.AuthError, actual.AuthError)
+		}
+		if authenticated := test.expected.AuthIssuer != ""; (actual.AuthExpiry != nil) != authenticated {
+			t.Errorf("%s: expected the token expiry to be logged only for authenticated requests, got %v", test.name, actual.AuthExpiry)
+		}
+	}
+}
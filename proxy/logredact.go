@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Redaction is how a sensitive value is written to the access log.
+type Redaction string
+
+const (
+	// RedactMask replaces all but the start and end of the value with asterisks.
+	RedactMask Redaction = "mask"
+	// RedactHash replaces the value with a truncated SHA-256 hash, so that requests can still be correlated.
+	RedactHash Redaction = "hash"
+	// RedactDrop removes the value from the log.
+	RedactDrop Redaction = "drop"
+)
+
+// RedactionRules maps headers, claims and query string parameters to how they are redacted in the access
+// log. Keys are prefixed with "header:", "claim:" or "query:", e.g. "header:X-Api-Key" or "query:api_key".
+// Header and query string parameter names are case insensitive.
+type RedactionRules map[string]Redaction
+
+// defaultRedactions prevent credentials from being logged, unless a different redaction is configured.
+var defaultRedactions = RedactionRules{
+	"header:authorization":       RedactDrop,
+	"header:proxy-authorization": RedactDrop,
+	"header:cookie":              RedactDrop,
+	"header:dpop":                RedactDrop,
+	"query:access_token":         RedactDrop,
+	"query:id_token":             RedactDrop,
+	"query:token":                RedactDrop,
+}
+
+// ParseRedactionRules parses a comma separated list of rules, e.g. "header:X-Api-Key=drop,claim:email=hash".
+func ParseRedactionRules(s string) (RedactionRules, error) {
+	rules := RedactionRules{}
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid redaction rule '%s', expected a format of 'header:name=mask'", r)
+		}
+		name := parts[0]
+		if !strings.HasPrefix(name, "header:") && !strings.HasPrefix(name, "claim:") && !strings.HasPrefix(name, "query:") {
+			return nil, fmt.Errorf("invalid redaction rule '%s', the name must start with 'header:', 'claim:' or 'query:'", r)
+		}
+		redaction := Redaction(parts[1])
+		if redaction != RedactMask && redaction != RedactHash && redaction != RedactDrop {
+			return nil, fmt.Errorf("invalid redaction rule '%s', expected one of 'mask', 'hash' or 'drop'", r)
+		}
+		rules[normalizeRedactionKey(name)] = redaction
+	}
+	return rules, nil
+}
+
+func normalizeRedactionKey(key string) string {
+	if strings.HasPrefix(key, "claim:") {
+		return key
+	}
+	return strings.ToLower(key)
+}
+
+// redaction returns how the named header, claim or query string parameter is redacted, and whether it
+// needs redacting at all.
+func (rules RedactionRules) redaction(kind, name string) (Redaction, bool) {
+	key := normalizeRedactionKey(kind + ":" + name)
+	if r, ok := rules[key]; ok {
+		return r, true
+	}
+	r, ok := defaultRedactions[key]
+	return r, ok
+}
+
+// redact applies the redaction to the value, returning false if the value should be dropped.
+func redact(value string, r Redaction) (string, bool) {
+	switch r {
+	case RedactDrop:
+		return "", false
+	case RedactHash:
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:8]), true
+	}
+	// Only reveal the start and end of long values.
+	if len(value) < 12 {
+		return "***", true
+	}
+	return value[:2] + "***" + value[len(value)-2:], true
+}
+
+// headers returns the selected request headers, with redactions applied.
+func (rules RedactionRules) headers(h http.Header, names []string) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	logged := make(map[string]string)
+	for _, name := range names {
+		values, ok := h[http.CanonicalHeaderKey(name)]
+		if !ok {
+			continue
+		}
+		value := strings.Join(values, ", ")
+		if r, ok := rules.redaction("header", name); ok {
+			if value, ok = redact(value, r); !ok {
+				continue
+			}
+		}
+		logged[name] = value
+	}
+	return logged
+}
+
+// claims returns the selected JWT claims, with redactions applied.
+func (rules RedactionRules) claims(claims map[string]interface{}, names []string) map[string]interface{} {
+	if len(names) == 0 || len(claims) == 0 {
+		return nil
+	}
+	logged := make(map[string]interface{})
+	for _, name := range names {
+		value, ok := claims[name]
+		if !ok {
+			continue
+		}
+		if r, ok := rules.redaction("claim", name); ok {
+			s, ok := redact(claimString(value), r)
+			if !ok {
+				continue
+			}
+			value = s
+		}
+		logged[name] = value
+	}
+	return logged
+}
+
+func claimString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// url returns the URL with redactions applied to the query string, keeping the order of the parameters.
+func (rules RedactionRules) url(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	var params []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		parts := strings.SplitN(param, "=", 2)
+		name, err := url.QueryUnescape(parts[0])
+		if err != nil {
+			name = parts[0]
+		}
+		r, ok := rules.redaction("query", name)
+		if !ok || len(parts) == 1 {
+			params = append(params, param)
+			continue
+		}
+		value, err := url.QueryUnescape(parts[1])
+		if err != nil {
+			value = parts[1]
+		}
+		if value, ok = redact(value, r); ok {
+			// Keep the asterisks of masked values readable.
+			params = append(params, parts[0]+"="+strings.Replace(url.QueryEscape(value), "%2A", "*", -1))
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = strings.Join(params, "&")
+	return redacted.String()
+}
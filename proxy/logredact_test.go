@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseRedactionRules(t *testing.T) {
+	rules, err := ParseRedactionRules("header:X-Api-Key=drop, claim:email=hash,query:API_KEY=mask")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := RedactionRules{
+		"header:x-api-key": RedactDrop,
+		"claim:email":      RedactHash,
+		"query:api_key":    RedactMask,
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("expected %v, got %v", expected, rules)
+	}
+
+	for _, invalid := range []string{"header:X-Api-Key", "cookie:session=drop", "claim:email=encrypt"} {
+		if _, err := ParseRedactionRules(invalid); err == nil {
+			t.Errorf("expected an error parsing '%s'", invalid)
+		}
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	rules := RedactionRules{
+		"header:x-api-key":     RedactHash,
+		"header:authorization": RedactMask,
+		"claim:email":          RedactMask,
+		"claim:roles":          RedactHash,
+		"claim:ssn":            RedactDrop,
+		"query:api_key":        RedactMask,
+	}
+
+	h := http.Header{}
+	h.Set("X-Partner-Id", "partner-1")
+	h.Set("X-Api-Key", "secret")
+	h.Set("Authorization", "Bearer abcdefghijklmnop")
+	h.Set("Cookie", "session=1")
+	actualHeaders := rules.headers(h, []string{"x-partner-id", "X-Api-Key", "Authorization", "Cookie", "X-Missing"})
+	expectedHeaders := map[string]string{
+		"x-partner-id":  "partner-1",
+		"X-Api-Key":     "sha256:2bb80d537b1da3e3",
+		"Authorization": "Be***op",
+	}
+	if !reflect.DeepEqual(actualHeaders, expectedHeaders) {
+		t.Errorf("expected headers %v, got %v", expectedHeaders, actualHeaders)
+	}
+
+	claims := map[string]interface{}{
+		"sub":   "user-1",
+		"email": "someone@example.com",
+		"roles": []interface{}{"admin"},
+		"ssn":   "123-45-6789",
+	}
+	actualClaims := rules.claims(claims, []string{"sub", "email", "roles", "ssn"})
+	expectedClaims := map[string]interface{}{
+		"sub":   "user-1",
+		"email": "so***om",
+		"roles": "sha256:c65da2d503b82552",
+	}
+	if !reflect.DeepEqual(actualClaims, expectedClaims) {
+		t.Errorf("expected claims %v, got %v", expectedClaims, actualClaims)
+	}
+
+	u, _ := url.Parse("/api/user?id=1&access_token=abc&api_key=xyz&name=a%20b")
+	expectedURL := "/api/user?id=1&api_key=***&name=a%20b"
+	if actual := rules.url(u); actual != expectedURL {
+		t.Errorf("expected URL '%s', got '%s'", expectedURL, actual)
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the Prometheus metrics exposed by the proxy.
+type Metrics struct {
+	Registry         *prometheus.Registry
+	Requests         *prometheus.CounterVec
+	RequestDuration  *prometheus.HistogramVec
+	AuthFailures     *prometheus.CounterVec
+	UpstreamErrors   *prometheus.CounterVec
+	RequestsInFlight prometheus.Gauge
+	KeyReloads       *prometheus.CounterVec
+	// IssuerCertificateExpiry is the expiry time of each issuer's certificate, for issuers whose key is
+	// a certificate.
+	IssuerCertificateExpiry *prometheus.GaugeVec
+}
+
+// NewMetrics creates the proxy's metrics, registering them with a new registry along with the Go runtime
+// and process metrics.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "jwtproxy_requests_total",
+			Help: "The number of requests handled, by route, status code and authenticated issuer.",
+		}, []string{"route", "status", "issuer"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "jwtproxy_request_duration_seconds",
+			Help:    "The time taken to handle requests, by route, status code and authenticated issuer.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "status", "issuer"}),
+		AuthFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "jwtproxy_auth_failures_total",
+			Help: "The number of requests which failed authentication, by reason.",
+		}, []string{"reason"}),
+		UpstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "jwtproxy_upstream_errors_total",
+			Help: "The number of requests which couldn't be proxied to the remote host, by reason.",
+		}, []string{"reason"}),
+		RequestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "jwtproxy_requests_in_flight",
+			Help: "The number of requests currently being handled.",
+		}),
+		KeyReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "jwtproxy_key_reloads_total",
+			Help: "The number of times the issuer keys have been loaded, by result.",
+		}, []string{"result"}),
+		IssuerCertificateExpiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "jwtproxy_issuer_certificate_expiry_timestamp_seconds",
+			Help: "The time that each issuer's certificate expires, as a Unix timestamp.",
+		}, []string{"issuer"}),
+	}
+	m.Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.Requests,
+		m.RequestDuration,
+		m.AuthFailures,
+		m.UpstreamErrors,
+		m.RequestsInFlight,
+		m.KeyReloads,
+		m.IssuerCertificateExpiry,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// KeysLoaded records the result of loading the issuer keys.
+func (m *Metrics) KeysLoaded(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.KeyReloads.WithLabelValues(result).Inc()
+}
+
+// IssuerCertificatesLoaded records the expiry time of each issuer's certificate, replacing the expiry
+// times of certificates which were previously loaded.
+func (m *Metrics) IssuerCertificatesLoaded(expiry map[string]time.Time) {
+	m.IssuerCertificateExpiry.Reset()
+	for issuer, notAfter := range expiry {
+		m.IssuerCertificateExpiry.WithLabelValues(issuer).Set(float64(notAfter.Unix()))
+	}
+}
+
+// MetricsHandler records metrics for each request.
+type MetricsHandler struct {
+	Metrics *Metrics
+	Next    http.Handler
+	Now     clock
+}
+
+// NewMetricsHandler creates a handler which records metrics for each request.
+func NewMetricsHandler(m *Metrics, next http.Handler) MetricsHandler {
+	return MetricsHandler{
+		Metrics: m,
+		Next:    next,
+		Now:     time.Now,
+	}
+}
+
+func (mh MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mh.Metrics.RequestsInFlight.Inc()
+	defer mh.Metrics.RequestsInFlight.Dec()
+
+	start := mh.Now()
+	// Authentication and upstream details are collected in the RequestLog, which is shared with the
+	// LoggingHandler if there is one.
+	r, requestLog := withRequestLog(r)
+	rw := &responseRecorder{ResponseWriter: w}
+
+	mh.Next.ServeHTTP(rw, r)
+
+	route := requestLog.Route
+	if route == "" {
+		route = "proxy"
+	}
+	status := strconv.Itoa(rw.status())
+	mh.Metrics.Requests.WithLabelValues(route, status, requestLog.AuthIssuer).Inc()
+	mh.Metrics.RequestDuration.WithLabelValues(route, status, requestLog.AuthIssuer).Observe(mh.Now().Sub(start).Seconds())
+	if requestLog.AuthError != "" {
+		mh.Metrics.AuthFailures.WithLabelValues(authFailureReason(requestLog.AuthError)).Inc()
+	}
+	if requestLog.UpstreamError != "" {
+		mh.Metrics.UpstreamErrors.WithLabelValues(requestLog.UpstreamError).Inc()
+	}
+}
+
+// authFailureReason groups authentication errors into a small set of reasons, so that the details of
+// errors (e.g. parse errors) don't create a new time series for each request.
+func authFailureReason(err string) string {
+	switch {
+	case err == "Required authorization token not found":
+		return "missing_token"
+	case strings.HasPrefix(err, "Authorization header format"):
+		return "invalid_scheme"
+	case strings.HasPrefix(err, "issuer certificate"):
+		return "issuer_certificate"
+	case strings.Contains(err, "expired"):
+		return "expired"
+	case strings.Contains(err, "iss not valid"):
+		return "unknown_issuer"
+	case strings.Contains(err, "signing method"):
+		return "invalid_algorithm"
+	case strings.Contains(err, "verification error"):
+		return "invalid_signature"
+	case strings.Contains(err, "DPoP"), strings.Contains(err, "cnf jkt"):
+		return "dpop"
+	case strings.Contains(err, "certificate"), strings.Contains(err, "x5t#S256"):
+		return "certificate"
+	}
+	return "invalid_token"
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.KeysLoaded(nil)
+	metrics.KeysLoaded(errors.New("failed"))
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l := requestLogFromContext(r.Context()); l != nil && r.URL.Path == "/unavailable" {
+			l.UpstreamError = "timeout"
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+	health := HealthCheckHandler{
+		Path: "/health",
+		Next: NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, upstream),
+	}
+	handler := NewMetricsHandler(metrics, health)
+
+	requests := []struct {
+		path          string
+		authorization string
+	}{
+		{path: "/health"},
+		{path: "/api"},
+		{path: "/api", authorization: "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com"})},
+		{path: "/api", authorization: "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com", "exp": 1})},
+		{path: "/unavailable", authorization: "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com"})},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest("GET", req.path, nil)
+		if req.authorization != "" {
+			r.Header.Set("Authorization", req.authorization)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+
+	expected := []string{
+		`jwtproxy_requests_total{issuer="",route="health",status="200"} 1`,
+		`jwtproxy_requests_total{issuer="",route="proxy",status="401"} 2`,
+		`jwtproxy_requests_total{issuer="example.com",route="proxy",status="200"} 1`,
+		`jwtproxy_requests_total{issuer="example.com",route="proxy",status="504"} 1`,
+		`jwtproxy_request_duration_seconds_count{issuer="example.com",route="proxy",status="200"} 1`,
+		`jwtproxy_auth_failures_total{reason="missing_token"} 1`,
+		`jwtproxy_auth_failures_total{reason="expired"} 1`,
+		`jwtproxy_upstream_errors_total{reason="timeout"} 1`,
+		`jwtproxy_requests_in_flight 0`,
+		`jwtproxy_key_reloads_total{result="success"} 1`,
+		`jwtproxy_key_reloads_total{result="failure"} 1`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(body), e) {
+			t.Errorf("expected metrics to contain '%s'", e)
+		}
+	}
+}
+
+func TestAuthFailureReason(t *testing.T) {
+	tests := []struct {
+		err      string
+		expected string
+	}{
+		{err: "Required authorization token not found", expected: "missing_token"},
+		{err: "Authorization header format must be Bearer {token} or DPoP {token}", expected: "invalid_scheme"},
+		{err: "Error parsing token: token expired", expected: "expired"},
+		{err: "issuer certificate expired", expected: "issuer_certificate"},
+		{err: "Error parsing token: iss not valid", expected: "unknown_issuer"},
+		{err: "Expected RS256 signing method but token specified HS256", expected: "invalid_algorithm"},
+		{err: "Error parsing token: crypto/rsa: verification error", expected: "invalid_signature"},
+		{err: "DPoP proof has already been used", expected: "dpop"},
+		{err: "cnf x5t#S256 does not match client certificate", expected: "certificate"},
+		{err: "Error parsing token: token contains an invalid number of segments", expected: "invalid_token"},
+	}
+
+	for _, test := range tests {
+		if actual := authFailureReason(test.err); actual != test.expected {
+			t.Errorf("%s: expected reason '%s', but got '%s'", test.err, test.expected, actual)
+		}
+	}
+}
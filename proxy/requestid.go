@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// DefaultRequestIDHeader is the header used to pass the request ID if no other header is configured.
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest incoming request ID that is accepted.
+const maxRequestIDLength = 128
+
+// RequestIDHandler makes sure that each request has an ID, so that the proxy's logs can be correlated with
+// the logs of the caller and the remote host. If the incoming request doesn't have a valid ID in the
+// header, a new ID is generated. The ID is returned to the caller in the same header.
+type RequestIDHandler struct {
+	Header   string
+	Generate func() string
+	Next     http.Handler
+}
+
+// NewRequestIDHandler creates a handler which uses the header to receive and return request IDs, e.g.
+// "X-Request-ID".
+func NewRequestIDHandler(header string, next http.Handler) RequestIDHandler {
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	return RequestIDHandler{
+		Header:   http.CanonicalHeaderKey(header),
+		Generate: newRequestID,
+		Next:     next,
+	}
+}
+
+type requestID struct {
+	Header string
+	Value  string
+}
+
+const requestIDKey = contextKey("requestID")
+
+func (h RequestIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(h.Header)
+	if !isValidRequestID(id) {
+		id = h.Generate()
+		r.Header.Set(h.Header, id)
+	}
+	w.Header().Set(h.Header, id)
+	ctx := context.WithValue(r.Context(), requestIDKey, requestID{Header: h.Header, Value: id})
+	h.Next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// isValidRequestID rejects IDs which are too long, or which could be used to forge log lines.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestIDFromContext returns the ID of the request, and the header that it's passed in.
+func requestIDFromContext(ctx context.Context) (requestID, bool) {
+	id, ok := ctx.Value(requestIDKey).(requestID)
+	return id, ok
+}
+
+// httpError writes an error response including the request ID, so that callers can quote it when
+// reporting problems.
+func httpError(w http.ResponseWriter, r *http.Request, error string, code int) {
+	if id, ok := requestIDFromContext(r.Context()); ok {
+		error += " (request ID " + id.Value + ")"
+	}
+	http.Error(w, error, code)
+}
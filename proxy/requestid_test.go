@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get("X-Correlation-ID")
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	tests := []struct {
+		name               string
+		id                 string
+		authorization      string
+		expectedID         string
+		expectedStatusCode int
+	}{
+		{
+			name:               "incoming ID is used",
+			id:                 "abc-123",
+			authorization:      "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com"}),
+			expectedID:         "abc-123",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "missing ID is generated",
+			authorization:      "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com"}),
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "ID containing a line break is replaced",
+			id:                 "abc\nstatus=200",
+			authorization:      "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com"}),
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "long ID is replaced",
+			id:                 strings.Repeat("a", maxRequestIDLength+1),
+			authorization:      "Bearer " + signTestToken(t, map[string]interface{}{"iss": "example.com"}),
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "ID is included in error responses",
+			id:                 "abc-456",
+			expectedID:         "abc-456",
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, test := range tests {
+		upstreamID = ""
+		log := new(bytes.Buffer)
+		logger := NewLoggingHandler(NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, NewReverseProxy(ReverseProxyOptions{Target: upstreamURL})))
+		logger.Stdout = log
+		handler := NewRequestIDHandler("x-correlation-id", logger)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.id != "" {
+			r.Header["X-Correlation-Id"] = []string{test.id}
+		}
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status code %d, but got %d", test.name, test.expectedStatusCode, w.Code)
+		}
+		id := w.Header().Get("X-Correlation-ID")
+		if test.expectedID != "" && id != test.expectedID {
+			t.Errorf("%s: expected ID '%s', but got '%s'", test.name, test.expectedID, id)
+		}
+		if test.expectedID == "" && !uuid.MatchString(id) {
+			t.Errorf("%s: expected a generated ID, but got '%s'", test.name, id)
+		}
+		if !strings.Contains(log.String(), `"RequestID":"`+id+`"`) {
+			t.Errorf("%s: expected the ID to be logged, but got '%s'", test.name, log.String())
+		}
+		if test.expectedStatusCode == http.StatusOK && upstreamID != id {
+			t.Errorf("%s: expected the ID '%s' to be passed upstream, but got '%s'", test.name, id, upstreamID)
+		}
+		if test.expectedStatusCode != http.StatusOK && !strings.Contains(w.Body.String(), "(request ID "+id+")") {
+			t.Errorf("%s: expected the ID to be included in the error response, but got '%s'", test.name, w.Body.String())
+		}
+	}
+}
+
+func TestRequestIDEchoedByUpstream(t *testing.T) {
+	tests := []struct {
+		name       string
+		upstreamID func(r *http.Request) string
+	}{
+		{
+			name:       "upstream echoes the ID",
+			upstreamID: func(r *http.Request) string { return r.Header.Get("X-Request-ID") },
+		},
+		{
+			name:       "upstream returns a different ID",
+			upstreamID: func(r *http.Request) string { return "upstream-id" },
+		},
+	}
+
+	for _, test := range tests {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Request-ID", test.upstreamID(r))
+			w.Write([]byte("OK"))
+		}))
+		upstreamURL, _ := url.Parse(upstream.URL)
+		handler := NewRequestIDHandler("", NewReverseProxy(ReverseProxyOptions{Target: upstreamURL}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Request-ID", "abc-123")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		upstream.Close()
+
+		if ids := w.Header()["X-Request-Id"]; len(ids) != 1 || ids[0] != "abc-123" {
+			t.Errorf("%s: expected a single request ID 'abc-123', but got %v", test.name, ids)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// ReverseProxyOptions configures the reverse proxy.
+type ReverseProxyOptions struct {
+	// Target is the URL of the remote host. Request paths are appended to its path.
+	Target *url.URL
+	// HostHeader is the Host header sent to the remote host. Defaults to the host of the Target.
+	HostHeader string
+	// Transport is used to make requests to the remote host. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+	// IssuerHeader and SubjectHeader are the request headers used to pass the issuer and subject of the
+	// token verified by the JWTAuthHandler to the remote host, e.g. "X-Auth-Issuer". Values sent by the
+	// caller are removed, so that the remote host can trust them. The headers aren't sent if not set.
+	IssuerHeader  string
+	SubjectHeader string
+}
+
+// NewReverseProxy creates a reverse proxy, which passes the request ID and authenticated caller to the
+// remote host and records the result in the access log.
+func NewReverseProxy(o ReverseProxyOptions) *httputil.ReverseProxy {
+	target, hostHeader := o.Target, o.HostHeader
+	targetQuery := target.RawQuery
+	director := func(req *http.Request) {
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		if targetQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = targetQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
+		}
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// explicitly disable User-Agent so it's not set to default value
+			req.Header.Set("User-Agent", "")
+		}
+		// Override the host header.
+		if hostHeader == "" {
+			req.Host = target.Host
+		} else {
+			req.Host = hostHeader
+		}
+		// Pass the authenticated caller to the remote host.
+		for _, h := range []string{o.IssuerHeader, o.SubjectHeader} {
+			if h != "" {
+				req.Header.Del(h)
+			}
+		}
+		if t, ok := VerifiedTokenFromContext(req.Context()); ok {
+			if o.IssuerHeader != "" {
+				req.Header.Set(o.IssuerHeader, t.Issuer)
+			}
+			if o.SubjectHeader != "" && t.Subject != "" {
+				req.Header.Set(o.SubjectHeader, t.Subject)
+			}
+		}
+		// Pass the request ID to the remote host.
+		if id, ok := requestIDFromContext(req.Context()); ok {
+			req.Header.Set(id.Header, id.Value)
+		}
+		// Record the address of the remote host in the access log.
+		if l := requestLogFromContext(req.Context()); l != nil {
+			trace := &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					l.Upstream = info.Conn.RemoteAddr().String()
+				},
+			}
+			*req = *req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		}
+	}
+	// The RequestIDHandler has already set the request ID in the response. The remote host's response
+	// headers are added to it, so drop the remote host's copy of the header, which may be an echo of the
+	// ID, rather than returning two values.
+	modifyResponse := func(resp *http.Response) error {
+		if id, ok := requestIDFromContext(resp.Request.Context()); ok {
+			resp.Header.Del(id.Header)
+		}
+		return nil
+	}
+	proxy := &httputil.ReverseProxy{Director: director, Transport: o.Transport, ModifyResponse: modifyResponse}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// The caller sent more than the BodyLimitHandler allows, so it's not a problem with the remote host.
+		if errors.Is(err, errBodyTooLarge) {
+			httpError(w, r, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		logf := log.Printf
+		if proxy.ErrorLog != nil {
+			logf = proxy.ErrorLog.Printf
+		}
+		if id, ok := requestIDFromContext(r.Context()); ok {
+			logf("http: proxy error: %v (request ID %s)", err, id.Value)
+		} else {
+			logf("http: proxy error: %v", err)
+		}
+		status, reason := http.StatusBadGateway, "error"
+		if isTimeout(err) {
+			status, reason = http.StatusGatewayTimeout, "timeout"
+		}
+		if l := requestLogFromContext(r.Context()); l != nil {
+			l.UpstreamError = reason
+		}
+		httpError(w, r, http.StatusText(status), status)
+	}
+	return proxy
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestThatPathsAreJoinedWithASlash(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		expected string
+	}{
+		{
+			a:        "/test/",
+			b:        "/b/",
+			expected: "/test/b/",
+		},
+		{
+			a:        "test",
+			b:        "b",
+			expected: "test/b",
+		},
+		{
+			a:        "test",
+			b:        "/b",
+			expected: "test/b",
+		},
+		{
+			a:        "test/",
+			b:        "b",
+			expected: "test/b",
+		},
+	}
+
+	for _, test := range tests {
+		actual := singleJoiningSlash(test.a, test.b)
+		if actual != test.expected {
+			t.Errorf("for '%v' and '%v', expected '%v' got '%v'", test.a, test.b, test.expected, actual)
+		}
+	}
+}
+
+func TestReverseProxyPassesTheCaller(t *testing.T) {
+	var received http.Header
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer remote.Close()
+	remoteURL, _ := url.Parse(remote.URL)
+
+	tests := []struct {
+		name            string
+		method          string
+		claims          map[string]interface{}
+		expectedIssuer  string
+		expectedSubject string
+	}{
+		{
+			name:            "authenticated",
+			method:          "GET",
+			claims:          map[string]interface{}{"iss": "example.com", "sub": "user-1"},
+			expectedIssuer:  "example.com",
+			expectedSubject: "user-1",
+		},
+		{
+			name:           "without a subject",
+			method:         "GET",
+			claims:         map[string]interface{}{"iss": "example.com"},
+			expectedIssuer: "example.com",
+		},
+		{
+			name:   "not authenticated",
+			method: "OPTIONS",
+		},
+	}
+
+	for _, test := range tests {
+		rp := NewReverseProxy(ReverseProxyOptions{Target: remoteURL, IssuerHeader: "X-Auth-Issuer", SubjectHeader: "X-Auth-Subject"})
+		handler := NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, rp)
+		r := httptest.NewRequest(test.method, "/", nil)
+		if test.claims != nil {
+			r.Header.Set("Authorization", "Bearer "+signTestToken(t, test.claims))
+		}
+		// Callers can't set the headers themselves.
+		r.Header.Set("X-Auth-Issuer", "attacker.com")
+		r.Header.Set("X-Auth-Subject", "admin")
+		received = nil
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if received == nil {
+			t.Errorf("%s: expected the request to be proxied", test.name)
+			continue
+		}
+		if actual := received.Get("X-Auth-Issuer"); actual != test.expectedIssuer {
+			t.Errorf("%s: expected issuer header '%s', but got '%s'", test.name, test.expectedIssuer, actual)
+		}
+		if actual := received.Get("X-Auth-Subject"); actual != test.expectedSubject {
+			t.Errorf("%s: expected subject header '%s', but got '%s'", test.name, test.expectedSubject, actual)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package proxy
 
 import (
 	"fmt"
@@ -29,7 +29,7 @@ func (h RewriteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	updatedURL, err := url.Parse(trimmedURL)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error trimming prefix '%v' from '%v', could not parse resulting URL of '%v'", h.PrefixToRemove, originalURL, trimmedURL), http.StatusInternalServerError)
+		httpError(w, r, fmt.Sprintf("Error trimming prefix '%v' from '%v', could not parse resulting URL of '%v'", h.PrefixToRemove, originalURL, trimmedURL), http.StatusInternalServerError)
 		return
 	}
 	r.URL = updatedURL
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ShutdownState tracks the number of requests in progress, and whether the proxy is draining connections
+// before it shuts down.
+type ShutdownState struct {
+	draining int32
+	active   int64
+}
+
+// Drain marks the proxy as draining, causing health checks to fail.
+func (s *ShutdownState) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// Draining returns true if the proxy is draining connections.
+func (s *ShutdownState) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Active returns the number of requests in progress.
+func (s *ShutdownState) Active() int64 {
+	return atomic.LoadInt64(&s.active)
+}
+
+// Track wraps the next handler to count the requests in progress.
+func (s *ShutdownState) Track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.active, 1)
+		defer atomic.AddInt64(&s.active, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Shutdown fails the health check, waits for the drain period to give load balancers time to stop sending
+// requests, then stops the server, waiting up to the timeout for requests in progress to complete.
+func (s *ShutdownState) Shutdown(server *http.Server, drainPeriod, timeout time.Duration, log io.Writer) error {
+	s.Drain()
+	fmt.Fprintf(log, "draining connections for %v\n", drainPeriod)
+	time.Sleep(drainPeriod)
+
+	fmt.Fprintf(log, "shutting down with %d requests in progress\n", s.Active())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down within %v, %d requests were still in progress: %v", timeout, s.Active(), err)
+	}
+	return nil
+}
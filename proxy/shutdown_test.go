@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name          string
+		requestTime   time.Duration
+		timeout       time.Duration
+		expectedError string
+	}{
+		{
+			name:        "requests complete before the timeout",
+			requestTime: 50 * time.Millisecond,
+			timeout:     time.Second,
+		},
+		{
+			name:          "requests still in progress at the timeout",
+			requestTime:   time.Second,
+			timeout:       50 * time.Millisecond,
+			expectedError: "1 requests were still in progress",
+		},
+	}
+
+	for _, test := range tests {
+		state := &ShutdownState{}
+		started := make(chan struct{})
+		server := &http.Server{
+			Handler: state.Track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(test.requestTime)
+			})),
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s: failed to listen: %v", test.name, err)
+		}
+		go server.Serve(listener)
+		go http.Get("http://" + listener.Addr().String())
+		<-started
+
+		if state.Active() != 1 {
+			t.Errorf("%s: expected 1 active request, got %d", test.name, state.Active())
+		}
+
+		log := new(bytes.Buffer)
+		err = state.Shutdown(server, 10*time.Millisecond, test.timeout, log)
+
+		if !state.Draining() {
+			t.Errorf("%s: expected the state to be draining", test.name)
+		}
+		if test.expectedError == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.expectedError != "" && (err == nil || !strings.Contains(err.Error(), test.expectedError)) {
+			t.Errorf("%s: expected error containing '%s', got %v", test.name, test.expectedError, err)
+		}
+		if !strings.Contains(log.String(), "shutting down with 1 requests in progress") {
+			t.Errorf("%s: expected the number of requests in progress to be logged, got '%s'", test.name, log.String())
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spanContext identifies a span within a trace, and is propagated between services using the W3C
+// traceparent and tracestate headers.
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+	// TraceState is the caller's tracestate header, which carries vendor specific trace data. It's passed
+	// on unchanged.
+	TraceState string
+}
+
+func (sc spanContext) isValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// traceparent formats the span context as a W3C traceparent header value.
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// parseTraceparent parses a W3C traceparent header value, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(v string) (sc spanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if !isLowerHex(parts[0]) || !isLowerHex(parts[1]) || !isLowerHex(parts[2]) || !isLowerHex(parts[3]) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	sc.Sampled = flags&1 == 1
+	return sc, sc.isValid()
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// spanKind is the OpenTelemetry span kind.
+type spanKind int
+
+const (
+	spanKindInternal spanKind = 1
+	spanKindServer   spanKind = 2
+	spanKindClient   spanKind = 3
+)
+
+// traceSpan is a timed operation within a trace.
+type traceSpan struct {
+	Name         string
+	Kind         spanKind
+	spanContext  spanContext
+	ParentSpanID [8]byte
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	// Error is the description of the error that the operation failed with, if any.
+	Error  string
+	tracer *tracer
+}
+
+// SetAttribute sets an attribute of the span. Spans may be nil if tracing is disabled.
+func (s *traceSpan) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *traceSpan) SetError(err string) {
+	if s == nil {
+		return
+	}
+	s.Error = err
+}
+
+// Finish ends the span, and exports it if it's sampled.
+func (s *traceSpan) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = s.tracer.now()
+	if s.spanContext.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// spanExporter sends finished spans to a tracing backend.
+type spanExporter interface {
+	Export(s *traceSpan)
+}
+
+// tracer creates spans.
+type tracer struct {
+	exporter spanExporter
+	// sampleRatio is the fraction of new traces which are sampled, from 0 to 1. Traces continued from a
+	// caller keep the caller's sampling decision.
+	sampleRatio float64
+	now         clock
+}
+
+// newTracer creates a tracer which exports the sampled spans to the exporter.
+func newTracer(exporter spanExporter, sampleRatio float64) *tracer {
+	return &tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+		now:         time.Now,
+	}
+}
+
+// sampled decides whether a new trace is sampled from its trace ID, which is random, in the same way as
+// the OpenTelemetry TraceIDRatioBased sampler, so that the decision is consistent across services.
+func (t *tracer) sampled(traceID [16]byte) bool {
+	if t.sampleRatio >= 1 {
+		return true
+	}
+	if t.sampleRatio <= 0 {
+		return false
+	}
+	threshold := uint64(t.sampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:16])>>1 < threshold
+}
+
+const spanKey = contextKey("span")
+
+// start starts a span which is a child of the parent, or a new trace if the parent is not valid.
+func (t *tracer) start(ctx context.Context, name string, kind spanKind, parent spanContext) (context.Context, *traceSpan) {
+	s := &traceSpan{
+		Name:       name,
+		Kind:       kind,
+		Start:      t.now(),
+		Attributes: map[string]interface{}{},
+		tracer:     t,
+	}
+	if parent.isValid() {
+		s.spanContext.TraceID = parent.TraceID
+		s.spanContext.Sampled = parent.Sampled
+		s.spanContext.TraceState = parent.TraceState
+		s.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(s.spanContext.TraceID[:])
+		s.spanContext.Sampled = t.sampled(s.spanContext.TraceID)
+	}
+	rand.Read(s.spanContext.SpanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// startSpan starts a child of the span in the context. If the request isn't being traced, the span is nil.
+func startSpan(ctx context.Context, name string, kind spanKind) (context.Context, *traceSpan) {
+	parent, ok := ctx.Value(spanKey).(*traceSpan)
+	if !ok {
+		return ctx, nil
+	}
+	return parent.tracer.start(ctx, name, kind, parent.spanContext)
+}
+
+// TracingOptions configures tracing.
+type TracingOptions struct {
+	// Endpoint is the URL of the OpenTelemetry collector, e.g. http://localhost:4318. If it has no path,
+	// spans are sent to /v1/traces.
+	Endpoint string
+	// SampleRatio is the fraction of new traces which are sampled, from 0 to 1. Traces continued from a
+	// caller keep the caller's sampling decision.
+	SampleRatio float64
+}
+
+// Tracing records a trace of each request, and sends the spans to an OpenTelemetry collector.
+type Tracing struct {
+	tracer   *tracer
+	exporter *otlpExporter
+}
+
+// NewTracing starts sending spans to the collector. Call Shutdown to send the remaining spans.
+func NewTracing(o TracingOptions) (*Tracing, error) {
+	exporter, err := newOTLPExporter(o.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracing{
+		tracer:   newTracer(exporter, o.SampleRatio),
+		exporter: exporter,
+	}, nil
+}
+
+// Handler creates a server span for each request, continuing the trace of the caller if the request
+// has a traceparent header. The tracestate header is kept with the trace.
+func (t *Tracing) Handler(next http.Handler) http.Handler {
+	return tracingHandler{tracer: t.tracer, next: next}
+}
+
+// Transport creates a client span for each round trip to the remote host, and passes the span's
+// context to the remote host in the traceparent and tracestate headers.
+func (t *Tracing) Transport(next http.RoundTripper) http.RoundTripper {
+	return tracingTransport{next: next}
+}
+
+// Shutdown sends any queued spans, waiting until they're sent or the context is cancelled.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	return t.exporter.Shutdown(ctx)
+}
+
+type tracingHandler struct {
+	tracer *tracer
+	next   http.Handler
+}
+
+func (th tracingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parent, ok := parseTraceparent(r.Header.Get("traceparent"))
+	if ok {
+		// The tracestate header is ignored without a valid traceparent.
+		parent.TraceState = r.Header.Get("tracestate")
+	}
+	ctx, span := th.tracer.start(r.Context(), r.Method, spanKindServer, parent)
+	r, requestLog := withRequestLog(r.WithContext(ctx))
+	rw := &responseRecorder{ResponseWriter: w}
+
+	th.next.ServeHTTP(rw, r)
+
+	route := requestLog.Route
+	if route == "" {
+		route = "proxy"
+	}
+	span.Name = r.Method + " " + route
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.Path)
+	span.SetAttribute("http.status_code", rw.status())
+	span.SetAttribute("jwtproxy.route", route)
+	if id, ok := requestIDFromContext(r.Context()); ok {
+		span.SetAttribute("jwtproxy.request_id", id.Value)
+	}
+	if requestLog.AuthIssuer != "" {
+		span.SetAttribute("jwtproxy.auth.issuer", requestLog.AuthIssuer)
+	}
+	if rw.status() >= http.StatusInternalServerError {
+		span.SetError(http.StatusText(rw.status()))
+	}
+	span.Finish()
+}
+
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := startSpan(req.Context(), "upstream", spanKindClient)
+	if span == nil {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(ctx)
+	req.Header.Set("traceparent", span.spanContext.traceparent())
+	if span.spanContext.TraceState != "" {
+		req.Header.Set("tracestate", span.spanContext.TraceState)
+	} else {
+		req.Header.Del("tracestate")
+	}
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.Path)
+	span.SetAttribute("net.peer.name", req.URL.Host)
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.SetError(err.Error())
+	} else {
+		span.SetAttribute("http.status_code", resp.StatusCode)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetError(resp.Status)
+		}
+	}
+	// The span covers the time taken to receive the response headers.
+	span.Finish()
+	return resp, err
+}
+
+// otlpExporter sends spans to an OpenTelemetry collector in batches, using OTLP/HTTP with JSON encoding.
+type otlpExporter struct {
+	// Endpoint is the URL that spans are posted to, e.g. http://localhost:4318/v1/traces.
+	Endpoint    string
+	ServiceName string
+	Client      *http.Client
+	Stderr      io.Writer
+	// BatchSize is the maximum number of spans sent in each request, and Interval is the maximum time that
+	// spans wait before being sent.
+	BatchSize int
+	Interval  time.Duration
+
+	mu     sync.Mutex
+	closed bool
+	spans  chan *traceSpan
+	done   chan struct{}
+}
+
+// newOTLPExporter creates an exporter which sends spans to the collector. If the endpoint has no path,
+// spans are sent to the default path of /v1/traces.
+func newOTLPExporter(endpoint string) (*otlpExporter, error) {
+	traces, err := OTLPTracesURL(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	e := &otlpExporter{
+		Endpoint:    traces,
+		ServiceName: "jwtproxy",
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Stderr:      os.Stderr,
+		BatchSize:   512,
+		Interval:    5 * time.Second,
+		spans:       make(chan *traceSpan, 2048),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// OTLPTracesURL returns the URL to send traces to, defaulting the path of the collector's endpoint to
+// /v1/traces.
+func OTLPTracesURL(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid OTLP endpoint '%s', expected a URL such as http://localhost:4318", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// Export queues the span to be sent. If the queue is full, the span is dropped rather than delaying the
+// request.
+func (e *otlpExporter) Export(s *traceSpan) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+// Shutdown sends any queued spans, waiting until they're sent or the context is cancelled.
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.spans)
+	}
+	e.mu.Unlock()
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to send spans with error %v", ctx.Err())
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	var batch []*traceSpan
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= e.BatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *otlpExporter) send(spans []*traceSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest(e.ServiceName, spans))
+	if err != nil {
+		fmt.Fprintf(e.Stderr, "failed to encode spans with error %v\n", err)
+		return
+	}
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(e.Stderr, "failed to send spans to %s with error %v\n", e.Endpoint, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(e.Stderr, "failed to send spans to %s, received status %s\n", e.Endpoint, resp.Status)
+	}
+}
+
+// The OTLP JSON encoding, see https://github.com/open-telemetry/opentelemetry-proto.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              spanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+func otlpRequest(serviceName string, spans []*traceSpan) otlpTraces {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/a-h/jwtproxy"}}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.spanContext.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.spanContext.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+			Status:            otlpStatus{Code: otlpStatusUnset},
+		}
+		if s.ParentSpanID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	return otlpTraces{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": serviceName})},
+				ScopeSpans: []otlpScopeSpans{scope},
+			},
+		},
+	}
+}
+
+func otlpAttributes(m map[string]interface{}) (attributes []otlpAttribute) {
+	for _, k := range sortedAttributeKeys(m) {
+		var v otlpValue
+		switch value := m[k].(type) {
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		attributes = append(attributes, otlpAttribute{Key: k, Value: v})
+	}
+	return attributes
+}
+
+func sortedAttributeKeys(m map[string]interface{}) []string {
+	keys := make(map[string]string, len(m))
+	for k := range m {
+		keys[k] = k
+	}
+	return sortedKeys(keys)
+}
@@ -0,0 +1,344 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name            string
+		traceparent     string
+		expectedOK      bool
+		expectedSampled bool
+	}{
+		{
+			name:            "sampled",
+			traceparent:     "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			expectedOK:      true,
+			expectedSampled: true,
+		},
+		{
+			name:        "not sampled",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			expectedOK:  true,
+		},
+		{
+			name:            "future version with extra fields",
+			traceparent:     "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			expectedOK:      true,
+			expectedSampled: true,
+		},
+		{
+			name:        "version 00 with extra fields",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		},
+		{
+			name:        "invalid version",
+			traceparent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "upper case",
+			traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "zero trace ID",
+			traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "zero span ID",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		},
+		{
+			name:        "short trace ID",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		},
+		{
+			name: "empty",
+		},
+	}
+
+	for _, test := range tests {
+		sc, ok := parseTraceparent(test.traceparent)
+		if ok != test.expectedOK {
+			t.Errorf("%s: expected ok %v, but got %v", test.name, test.expectedOK, ok)
+			continue
+		}
+		if ok && sc.Sampled != test.expectedSampled {
+			t.Errorf("%s: expected sampled %v, but got %v", test.name, test.expectedSampled, sc.Sampled)
+		}
+		if !ok || !test.expectedSampled {
+			continue
+		}
+		// Version 00 is always sent, whatever version was received.
+		if expected := "00" + test.traceparent[2:55]; sc.traceparent() != expected {
+			t.Errorf("%s: expected traceparent '%s', but got '%s'", test.name, expected, sc.traceparent())
+		}
+	}
+}
+
+// otlpCollector is a stub OpenTelemetry collector which records the spans it receives.
+type otlpCollector struct {
+	mu    sync.Mutex
+	spans map[string]otlpSpan
+	paths []string
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var traces otlpTraces
+	if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, r.URL.Path)
+	for _, rs := range traces.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				c.spans[s.Name] = s
+			}
+		}
+	}
+}
+
+func (s otlpSpan) attribute(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key != key {
+			continue
+		}
+		switch {
+		case a.Value.StringValue != nil:
+			return *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			return *a.Value.IntValue
+		}
+	}
+	return ""
+}
+
+func TestTracing(t *testing.T) {
+	collector := &otlpCollector{spans: map[string]otlpSpan{}}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	var upstreamTraceparent, upstreamTracestate string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		upstreamTracestate = r.Header.Get("tracestate")
+		w.Write([]byte("OK"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	tracing, err := NewTracing(TracingOptions{Endpoint: collectorServer.URL, SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("failed to create tracing: %v", err)
+	}
+	proxy := NewReverseProxy(ReverseProxyOptions{Target: upstreamURL, Transport: tracing.Transport(http.DefaultTransport)})
+	handler := tracing.Handler(NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, proxy))
+
+	r := httptest.NewRequest("GET", "/api/user", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("tracestate", "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7")
+	r.Header.Set("Authorization", "Bearer "+signTestToken(t, map[string]interface{}{"iss": "example.com"}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracing.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down tracing: %v", err)
+	}
+
+	if len(collector.paths) != 1 || collector.paths[0] != "/v1/traces" {
+		t.Errorf("expected spans to be sent to /v1/traces in a single batch, but got %v", collector.paths)
+	}
+	server, auth, client := collector.spans["GET proxy"], collector.spans["auth.jwt"], collector.spans["upstream"]
+	for name, s := range map[string]otlpSpan{"server": server, "auth": auth, "upstream": client} {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%s: expected the span to continue the incoming trace, but got trace ID '%s'", name, s.TraceID)
+		}
+	}
+	if server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != spanKindServer {
+		t.Errorf("expected a server span with the incoming parent, but got parent '%s' and kind %d", server.ParentSpanID, server.Kind)
+	}
+	if auth.ParentSpanID != server.SpanID || auth.attribute("jwtproxy.auth.issuer") != "example.com" {
+		t.Errorf("expected an auth span for example.com within the server span, but got %+v", auth)
+	}
+	if client.ParentSpanID != server.SpanID || client.Kind != spanKindClient || client.attribute("http.status_code") != "200" {
+		t.Errorf("expected a successful upstream client span within the server span, but got %+v", client)
+	}
+	if server.attribute("jwtproxy.route") != "proxy" || server.attribute("http.status_code") != "200" || server.attribute("jwtproxy.auth.issuer") != "example.com" {
+		t.Errorf("expected the server span to have route, status and issuer attributes, but got %+v", server.Attributes)
+	}
+	expectedTraceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + client.SpanID + "-01"
+	if upstreamTraceparent != expectedTraceparent {
+		t.Errorf("expected the upstream traceparent '%s', but got '%s'", expectedTraceparent, upstreamTraceparent)
+	}
+	if upstreamTracestate != "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7" {
+		t.Errorf("expected the incoming tracestate to be passed upstream unchanged, but got '%s'", upstreamTracestate)
+	}
+}
+
+func TestTracestate(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		tracestate  string
+		expected    string
+	}{
+		{
+			name:        "passed on with the trace",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			tracestate:  "congo=t61rcWkgMzE",
+			expected:    "congo=t61rcWkgMzE",
+		},
+		{
+			name:        "not set by the caller",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "dropped with an invalid traceparent",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			tracestate:  "congo=t61rcWkgMzE",
+		},
+		{
+			name:       "dropped without a traceparent",
+			tracestate: "congo=t61rcWkgMzE",
+		},
+	}
+
+	for _, test := range tests {
+		var upstreamTracestate []string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamTracestate = r.Header["Tracestate"]
+		}))
+		upstreamURL, _ := url.Parse(upstream.URL)
+		transport := tracingTransport{next: http.DefaultTransport}
+		proxy := NewReverseProxy(ReverseProxyOptions{Target: upstreamURL, Transport: transport})
+		handler := tracingHandler{tracer: newTracer(&spanRecorder{}, 1), next: proxy}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.traceparent != "" {
+			r.Header.Set("traceparent", test.traceparent)
+		}
+		if test.tracestate != "" {
+			r.Header.Set("tracestate", test.tracestate)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		upstream.Close()
+
+		if strings.Join(upstreamTracestate, ",") != test.expected {
+			t.Errorf("%s: expected the upstream tracestate '%s', but got %v", test.name, test.expected, upstreamTracestate)
+		}
+	}
+}
+
+func TestTracingFailedAuthentication(t *testing.T) {
+	collector := &otlpCollector{spans: map[string]otlpSpan{}}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	tracing, err := NewTracing(TracingOptions{Endpoint: collectorServer.URL + "/custom/traces", SampleRatio: 1})
+	if err != nil {
+		t.Fatalf("failed to create tracing: %v", err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := tracing.Handler(NewJWTAuthHandler(JWTAuthOptions{Keys: NewKeyStore(testKeys)}, next))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	tracing.Shutdown(context.Background())
+
+	if len(collector.paths) != 1 || collector.paths[0] != "/custom/traces" {
+		t.Errorf("expected spans to be sent to /custom/traces, but got %v", collector.paths)
+	}
+	auth := collector.spans["auth.jwt"]
+	if auth.Status.Code != otlpStatusError || !strings.Contains(auth.Status.Message, "token not found") {
+		t.Errorf("expected the auth span to record the error, but got %+v", auth.Status)
+	}
+	if server := collector.spans["GET proxy"]; server.ParentSpanID != "" || server.attribute("http.status_code") != "401" {
+		t.Errorf("expected a new trace with a 401 status, but got %+v", server)
+	}
+}
+
+// spanRecorder is a spanExporter which counts the spans it receives.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans int
+}
+
+func (r *spanRecorder) Export(s *traceSpan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans++
+}
+
+func TestTracingSampleRatio(t *testing.T) {
+	tests := []struct {
+		name        string
+		sampleRatio float64
+		traceparent string
+		requests    int
+		minSpans    int
+		maxSpans    int
+	}{
+		{
+			name:        "new traces are all sampled",
+			sampleRatio: 1,
+			requests:    100,
+			minSpans:    100,
+			maxSpans:    100,
+		},
+		{
+			name:        "new traces are not sampled",
+			sampleRatio: 0,
+			requests:    100,
+		},
+		{
+			name:        "half of new traces are sampled",
+			sampleRatio: 0.5,
+			requests:    1000,
+			minSpans:    400,
+			maxSpans:    600,
+		},
+		{
+			name:        "the caller's decision to sample is kept",
+			sampleRatio: 0,
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			requests:    100,
+			minSpans:    100,
+			maxSpans:    100,
+		},
+		{
+			name:        "the caller's decision not to sample is kept",
+			sampleRatio: 1,
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			requests:    100,
+		},
+	}
+
+	for _, test := range tests {
+		recorder := &spanRecorder{}
+		handler := tracingHandler{tracer: newTracer(recorder, test.sampleRatio), next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+		for i := 0; i < test.requests; i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.traceparent != "" {
+				r.Header.Set("traceparent", test.traceparent)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+		}
+		if recorder.spans < test.minSpans || recorder.spans > test.maxSpans {
+			t.Errorf("%s: expected between %d and %d spans, but got %d", test.name, test.minSpans, test.maxSpans, recorder.spans)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// UpstreamOptions configures how the proxy connects to the remote URL.
+type UpstreamOptions struct {
+	// CAFile is the location of a PEM encoded CA bundle to trust in addition to the system roots.
+	CAFile string
+	// CertFile and KeyFile are the locations of a PEM encoded client certificate and private key to present
+	// to the remote.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used for SNI and to verify the remote's certificate.
+	ServerName string
+	// InsecureSkipVerify disables verification of the remote's certificate. Only use this in development.
+	InsecureSkipVerify bool
+
+	// DialTimeout, TLSHandshakeTimeout, ResponseHeaderTimeout and IdleConnTimeout limit how long connecting
+	// to the remote, completing the TLS handshake, waiting for response headers and keeping idle connections
+	// open can take. Zero values use the defaults of http.DefaultTransport.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	// MaxIdleConns, MaxIdleConnsPerHost and MaxConnsPerHost limit the size of the connection pool. Zero
+	// values use the defaults of http.DefaultTransport.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+}
+
+// NewUpstreamTransport creates the transport used by the reverse proxy to connect to the remote URL.
+func NewUpstreamTransport(o UpstreamOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if o.DialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   o.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if o.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = o.TLSHandshakeTimeout
+	}
+	if o.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = o.ResponseHeaderTimeout
+	}
+	if o.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.MaxIdleConns > 0 {
+		transport.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.MaxConnsPerHost > 0 {
+		transport.MaxConnsPerHost = o.MaxConnsPerHost
+	}
+	config := &tls.Config{
+		ServerName:         o.ServerName,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read file %s with error %v", o.CAFile, err)
+		}
+		config.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM encoded certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate %s and key %s with error %v", o.CertFile, o.KeyFile, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	transport.TLSClientConfig = config
+	return transport, nil
+}
+
+// isTimeout returns true if the error returned by the transport was caused by a timeout.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// UpstreamReachable returns a health check which succeeds if a TCP connection can be made to the remote.
+func UpstreamReachable(target *url.URL, timeout time.Duration) func() error {
+	addr := target.Host
+	if target.Port() == "" {
+		port := "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(target.Hostname(), port)
+	}
+	return func() error {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTransport(t *testing.T) {
+	var clientCertificates int
+	remote := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCertificates = len(r.TLS.PeerCertificates)
+		w.Write([]byte("OK"))
+	}))
+	remote.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	remote.Config.ErrorLog = discardLogger
+	remote.StartTLS()
+	defer remote.Close()
+
+	dir, err := ioutil.TempDir("", "jwtproxy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", remote.Certificate().Raw)
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	writeClientCertificate(t, certFile, keyFile)
+
+	tests := []struct {
+		name                       string
+		options                    UpstreamOptions
+		expectError                bool
+		expectedClientCertificates int
+	}{
+		{
+			name:        "untrusted remote",
+			options:     UpstreamOptions{},
+			expectError: true,
+		},
+		{
+			name:    "custom CA",
+			options: UpstreamOptions{CAFile: caFile},
+		},
+		{
+			name:    "server name matching the remote's certificate",
+			options: UpstreamOptions{CAFile: caFile, ServerName: "example.com"},
+		},
+		{
+			name:        "server name not matching the remote's certificate",
+			options:     UpstreamOptions{CAFile: caFile, ServerName: "example.org"},
+			expectError: true,
+		},
+		{
+			name:    "insecure skip verify",
+			options: UpstreamOptions{InsecureSkipVerify: true},
+		},
+		{
+			name:                       "client certificate",
+			options:                    UpstreamOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+			expectedClientCertificates: 1,
+		},
+	}
+
+	for _, test := range tests {
+		clientCertificates = 0
+		transport, err := NewUpstreamTransport(test.options)
+		if err != nil {
+			t.Fatalf("%s: failed to create transport: %v", test.name, err)
+		}
+		remoteURL, _ := url.Parse(remote.URL)
+		proxy := NewReverseProxy(ReverseProxyOptions{Target: remoteURL})
+		proxy.Transport = transport
+		proxy.ErrorLog = discardLogger
+
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if test.expectError && w.Code != http.StatusBadGateway {
+			t.Errorf("%s: expected a bad gateway error, but got %v", test.name, w.Code)
+		}
+		if !test.expectError && w.Code != http.StatusOK {
+			t.Errorf("%s: expected OK, but got %v", test.name, w.Code)
+		}
+		if clientCertificates != test.expectedClientCertificates {
+			t.Errorf("%s: expected %d client certificates, but got %d", test.name, test.expectedClientCertificates, clientCertificates)
+		}
+	}
+}
+
+var discardLogger = log.New(ioutil.Discard, "", 0)
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func writeClientCertificate(t *testing.T, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "jwtproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+}
+
+func TestUpstreamTimeoutsReturnGatewayTimeout(t *testing.T) {
+	release := make(chan struct{})
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("OK"))
+	}))
+	defer remote.Close()
+	defer close(release)
+
+	transport, err := NewUpstreamTransport(UpstreamOptions{ResponseHeaderTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	remoteURL, _ := url.Parse(remote.URL)
+	proxy := NewReverseProxy(ReverseProxyOptions{Target: remoteURL})
+	proxy.Transport = transport
+	proxy.ErrorLog = discardLogger
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected a gateway timeout, but got %v", w.Code)
+	}
+}
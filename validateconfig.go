@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-h/jwtproxy/proxy"
+)
+
+// validateConfigCommand checks the configuration without starting the proxy, e.g. in CI. It accepts
+// the same command line flags as the proxy, and reads the same environment variables and config file.
+func validateConfigCommand(args []string, stdout io.Writer) int {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 2
+	}
+	d := &diagnostics{w: stdout}
+	validateConfig(d, os.Environ())
+	if d.failures > 0 {
+		fmt.Fprintf(stdout, "FAIL: %d error(s), %d warning(s)\n", d.failures, d.warnings)
+		return 1
+	}
+	fmt.Fprintf(stdout, "OK: %d warning(s)\n", d.warnings)
+	return 0
+}
+
+// diagnostics prints the result of each check.
+type diagnostics struct {
+	w        io.Writer
+	failures int
+	warnings int
+}
+
+func (d *diagnostics) ok(name, format string, a ...interface{}) {
+	fmt.Fprintf(d.w, "ok    %s: %s\n", name, fmt.Sprintf(format, a...))
+}
+
+func (d *diagnostics) warn(name, format string, a ...interface{}) {
+	d.warnings++
+	fmt.Fprintf(d.w, "warn  %s: %s\n", name, fmt.Sprintf(format, a...))
+}
+
+func (d *diagnostics) fail(name string, err error) {
+	d.failures++
+	fmt.Fprintf(d.w, "fail  %s: %v\n", name, err)
+}
+
+// check prints the result of a check which can only pass or fail.
+func (d *diagnostics) check(name string, err error, format string, a ...interface{}) bool {
+	if err != nil {
+		d.fail(name, err)
+		return false
+	}
+	d.ok(name, format, a...)
+	return true
+}
+
+// validateConfig runs the same steps as starting the proxy, without listening or opening files for
+// writing, and continues after errors so that every problem is reported at once.
+func validateConfig(d *diagnostics, environ []string) {
+	if path := settings.getString("config"); path == "" {
+		d.ok("config", "no config file")
+	} else if !d.check("config", settings.loadFile(), "loaded %s", path) {
+		// The remaining settings may be wrong without the file.
+		return
+	}
+
+	// Check that every number, duration and boolean setting can be parsed.
+	settings.flags.VisitAll(func(f *flag.Flag) {
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return
+		}
+		var err error
+		switch getter.Get().(type) {
+		case time.Duration:
+			_, err = settings.getDuration(f.Name)
+		case int:
+			_, err = settings.getInt(f.Name)
+		case bool:
+			_, err = settings.getBool(f.Name)
+		case float64:
+			_, err = settings.getFloat(f.Name)
+		}
+		if err != nil {
+			d.fail(f.Name, err)
+		}
+	})
+
+	validateListener(d)
+	remoteHostHeader := getRemoteHostHeader()
+	if remoteURL, err := getRemoteURL(); err != nil {
+		d.fail("remoteURL", err)
+	} else if (remoteURL.Scheme != "http" && remoteURL.Scheme != "https") || remoteURL.Host == "" {
+		d.fail("remoteURL", fmt.Errorf("invalid remote URL '%s', expected an absolute http or https URL", remoteURL))
+	} else {
+		d.ok("remoteURL", "%s", remoteURL)
+	}
+	if o, err := getUpstreamOptions(remoteHostHeader); err != nil {
+		d.fail("upstream", err)
+	} else if _, err := proxy.NewUpstreamTransport(o); err != nil {
+		d.fail("upstream", err)
+	} else if o.InsecureSkipVerify {
+		d.warn("upstream", "verification of the remote host's TLS certificate is disabled")
+	} else {
+		d.ok("upstream", "TLS settings loaded")
+	}
+	for _, name := range []string{"remoteIssuerHeader", "remoteSubjectHeader"} {
+		if header := settings.getString(name); strings.ContainsAny(header, " :\r\n") {
+			d.fail(name, fmt.Errorf("invalid header name '%s'", header))
+		}
+	}
+
+	authMode, err := getAuthMode()
+	if err != nil {
+		d.fail("auth", err)
+		return
+	}
+	d.ok("auth", "%s", authMode)
+	tlsConfig, err := getTLSConfig(authMode)
+	if tlsConfig == nil && err == nil {
+		d.ok("tls", "disabled, the proxy listens using plain HTTP")
+	} else {
+		d.check("tls", err, "certificate loaded")
+	}
+
+	keys, err := getKeys(environ)
+	if err != nil {
+		d.fail("keys", err)
+	}
+	jwksURLs, err := getJWKSURLs()
+	if err != nil {
+		d.fail("jwksURLs", err)
+	}
+	validateIssuers(d, authMode, keys, jwksURLs)
+
+	identities, err := getClientCertificateIdentities(authMode)
+	if err != nil {
+		d.fail("clientCerts", err)
+	} else if authMode == authModeBoth {
+		for _, subject := range sortedKeys(identities) {
+			if !hasKey(keys, jwksURLs, identities[subject]) {
+				d.fail("clientCerts", fmt.Errorf("client certificate '%s' maps to issuer '%s', which has no key", subject, identities[subject]))
+			}
+		}
+	}
+	if trusted, err := getTrustedProxies(); err != nil {
+		d.fail("trustedProxies", err)
+	} else if len(trusted) > 0 {
+		d.ok("trustedProxies", "X-Forwarded-Proto is trusted from %d networks", len(trusted))
+	}
+	if (tlsConfig == nil || tlsConfig.ClientAuth == tls.NoClientCert) && len(getCertificateBoundIssuers()) > 0 {
+		d.warn("certBoundIssuers", "client certificates aren't requested, so tokens from certificate bound issuers will be rejected")
+	}
+
+	validateLogging(d)
+}
+
+func validateListener(d *diagnostics) {
+	if port, err := getPort(); err != nil {
+		d.fail("port", err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		d.fail("port", fmt.Errorf("invalid port '%s', expected a number between 1 and 65535", port))
+	} else {
+		d.ok("port", "%s", port)
+	}
+
+	switch prefix := getPrefix(); {
+	case prefix == "":
+		d.ok("prefix", "none, paths are proxied unchanged")
+	case !strings.HasPrefix(prefix, "/"):
+		d.fail("prefix", fmt.Errorf("invalid prefix '%s', expected a path starting with /", prefix))
+	default:
+		d.ok("prefix", "'%s' is removed from paths before they're proxied", prefix)
+	}
+
+	paths := map[string]string{}
+	for _, p := range []struct{ name, path string }{
+		{"health", getHealthCheckURI()},
+		{"live", getLivenessURI()},
+		{"ready", getReadinessURI()},
+	} {
+		switch {
+		case p.path == "":
+			continue
+		case !strings.HasPrefix(p.path, "/"):
+			d.fail(p.name, fmt.Errorf("invalid path '%s', expected a path starting with /", p.path))
+		case paths[p.path] != "":
+			d.fail(p.name, fmt.Errorf("path '%s' is already used by %s", p.path, paths[p.path]))
+		default:
+			d.ok(p.name, "%s", p.path)
+		}
+		paths[p.path] = p.name
+	}
+}
+
+// validateIssuers prints the key and policies of each issuer. The key sets of issuers with a JWKS URL aren't
+// fetched.
+func validateIssuers(d *diagnostics, authMode string, keys, jwksURLs map[string]string) {
+	certBound, dpop := getCertificateBoundIssuers(), getDPoPIssuers()
+	allowExpired, err := getAllowExpiredCertificates()
+	if err != nil {
+		d.fail("keysCertExpiry", err)
+	}
+	warnBefore, _ := settings.getDuration("keysCertWarnBefore")
+	now := time.Now()
+	for _, info := range proxy.KeyInventory(keys) {
+		name := "issuer " + info.Issuer
+		if info.Error != "" {
+			d.fail(name, fmt.Errorf("%s", info.Error))
+			continue
+		}
+		var policies []string
+		if certBound[info.Issuer] {
+			policies = append(policies, "certificate bound")
+		}
+		if dpop[info.Issuer] {
+			policies = append(policies, "DPoP")
+		}
+		detail := fmt.Sprintf("%s key %s, algorithms %s", info.Type, info.Fingerprint, strings.Join(info.Algorithms, ", "))
+		if len(policies) > 0 {
+			detail += ", requires " + strings.Join(policies, " and ")
+		}
+		if info.NotAfter == nil {
+			d.ok(name, "%s", detail)
+			continue
+		}
+		detail += fmt.Sprintf(", certificate %s expires %s", info.Subject, info.NotAfter.Format(time.RFC3339))
+		switch {
+		case now.After(*info.NotAfter) && !allowExpired:
+			d.fail(name, fmt.Errorf("%s, the certificate has expired so tokens will be rejected", detail))
+		case now.After(*info.NotAfter):
+			d.warn(name, "%s, the certificate has expired", detail)
+		case now.Add(warnBefore).After(*info.NotAfter):
+			d.warn(name, "%s, the certificate expires soon", detail)
+		default:
+			d.ok(name, "%s", detail)
+		}
+	}
+	for _, issuer := range sortedKeys(jwksURLs) {
+		if _, ok := keys[issuer]; ok {
+			d.warn("issuer "+issuer, "has a key, so the key set at %s isn't used", jwksURLs[issuer])
+			continue
+		}
+		d.ok("issuer "+issuer, "key set %s", jwksURLs[issuer])
+	}
+	for _, policy := range []struct {
+		name    string
+		issuers map[string]bool
+	}{{"certBoundIssuers", certBound}, {"dpopIssuers", dpop}} {
+		for _, issuer := range sortedSet(policy.issuers) {
+			if !hasKey(keys, jwksURLs, issuer) {
+				d.fail(policy.name, fmt.Errorf("issuer '%s' has no key", issuer))
+			}
+		}
+	}
+	if authMode != authModeCert && len(keys) == 0 && len(jwksURLs) == 0 {
+		d.fail("keys", fmt.Errorf("no issuer keys are loaded, so every token will be rejected"))
+	}
+}
+
+// hasKey returns true if the issuer has a key, or a JWKS URL to fetch its keys from.
+func hasKey(keys, jwksURLs map[string]string, issuer string) bool {
+	_, hasKey := keys[issuer]
+	_, hasKeySet := jwksURLs[issuer]
+	return hasKey || hasKeySet
+}
+
+func validateLogging(d *diagnostics) {
+	_, err := getLogFormat()
+	d.check("logFormat", err, "%s", orDefault(settings.getString("logFormat"), "json"))
+	_, err = getLogRedactions()
+	d.check("logRedact", err, "%d rule(s)", len(splitList(settings.getString("logRedact"))))
+	if header := getRequestIDHeader(); header == "" || strings.ContainsAny(header, " :\r\n") {
+		d.fail("requestIDHeader", fmt.Errorf("invalid header name '%s'", header))
+	}
+	if path := settings.getString("auditLog"); path != "" {
+		// Don't create the audit log, just check that it could be.
+		_, err := os.Stat(filepath.Dir(path))
+		d.check("auditLog", err, "%s", path)
+		if keyFile := settings.getString("auditKey"); keyFile == "" {
+			d.warn("auditKey", "not set, so anyone who can write to the audit log can recalculate its chain")
+		} else {
+			_, err := readAuditKey(keyFile)
+			d.check("auditKey", err, "%s", keyFile)
+		}
+	}
+	if endpoint := settings.getString("otlpEndpoint"); endpoint != "" {
+		traces, err := proxy.OTLPTracesURL(endpoint)
+		d.check("otlpEndpoint", err, "%s", traces)
+		ratio, err := getOTLPSampleRatio()
+		d.check("otlpSampleRatio", err, "%v of new traces are sampled", ratio)
+	}
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name             string
+		env              map[string]string
+		environ          []string
+		expectedFailures int
+		expectedOutput   []string
+	}{
+		{
+			name: "valid configuration",
+			env: map[string]string{
+				"JWTPROXY_REMOTE_URL":  "https://api.example.com",
+				"JWTPROXY_LISTEN_PORT": "9090",
+				"JWTPROXY_CONFIG":      "keys.json",
+				"JWTPROXY_PREFIX":      "/api",
+			},
+			expectedOutput: []string{
+				"ok    remoteURL: https://api.example.com",
+				"ok    issuer example.com: RSA-2048 key sha256:9d344de7a23758c69cb734e1d34084efc7fe0fbaaab1c7ce68b94f3d6dc60d34, algorithms RS256, RS384, RS512, PS256, PS384, PS512",
+			},
+		},
+		{
+			name: "every error is reported",
+			env: map[string]string{
+				"JWTPROXY_REMOTE_URL":         "api.example.com",
+				"JWTPROXY_LISTEN_PORT":        "http",
+				"JWTPROXY_DRAIN_PERIOD":       "10",
+				"JWTPROXY_LIVENESS_URI":       "/health",
+				"JWTPROXY_DPOP_ISSUERS":       "example.org",
+				"JWTPROXY_CERT_BOUND_ISSUERS": "example.com",
+				"JWTPROXY_TRUSTED_PROXIES":    "10.0.0.1,10.0.0.0/33",
+			},
+			environ: []string{
+				"JWTPROXY_ISSUER_0=example.com",
+				"JWTPROXY_PUBLIC_KEY_0=" + testKeys["example.com"],
+				"JWTPROXY_ISSUER_1=invalid.com",
+				"JWTPROXY_PUBLIC_KEY_1=not a key",
+			},
+			expectedFailures: 7,
+			expectedOutput: []string{
+				"fail  drainPeriod: failed to parse JWTPROXY_DRAIN_PERIOD value 10",
+				"fail  port: invalid port 'http'",
+				"fail  live: path '/health' is already used by health",
+				"fail  remoteURL: invalid remote URL 'api.example.com'",
+				"fail  issuer invalid.com: key is not PEM encoded",
+				"fail  dpopIssuers: issuer 'example.org' has no key",
+				"fail  trustedProxies: invalid trusted proxy '10.0.0.0/33'",
+				"ok    issuer example.com: RSA-2048 key",
+				"requires certificate bound",
+				"warn  certBoundIssuers: client certificates aren't requested",
+			},
+		},
+		{
+			name: "invalid JWKS URLs",
+			env: map[string]string{
+				"JWTPROXY_REMOTE_URL":  "https://api.example.com",
+				"JWTPROXY_LISTEN_PORT": "9090",
+				"JWTPROXY_JWKS_URLS":   "idp.example.com=https://idp.example.com/jwks.json,other.com=jwks.json",
+			},
+			expectedFailures: 2,
+			expectedOutput: []string{
+				"fail  jwksURLs: invalid JWKS URL 'jwks.json' for issuer 'other.com'",
+				"fail  keys: no issuer keys are loaded",
+			},
+		},
+		{
+			name: "JWKS URLs are used instead of keys",
+			env: map[string]string{
+				"JWTPROXY_REMOTE_URL":   "https://api.example.com",
+				"JWTPROXY_LISTEN_PORT":  "9090",
+				"JWTPROXY_JWKS_URLS":    "idp.example.com=https://idp.example.com/jwks.json",
+				"JWTPROXY_DPOP_ISSUERS": "idp.example.com",
+			},
+			expectedOutput: []string{
+				"ok    issuer idp.example.com: key set https://idp.example.com/jwks.json",
+			},
+		},
+		{
+			name: "missing keys",
+			env: map[string]string{
+				"JWTPROXY_REMOTE_URL":  "https://api.example.com",
+				"JWTPROXY_LISTEN_PORT": "9090",
+				"JWTPROXY_CONFIG":      "missing.json",
+			},
+			expectedFailures: 2,
+			expectedOutput: []string{
+				"fail  keys: Failed to open file missing.json",
+				"fail  keys: no issuer keys are loaded",
+			},
+		},
+	}
+
+	defer func(s *settingSources) { settings = s }(settings)
+	for _, test := range tests {
+		env := test.env
+		settings = &settingSources{flags: flag.CommandLine, getenv: func(name string) string { return env[name] }}
+		var stdout bytes.Buffer
+		d := &diagnostics{w: &stdout}
+		validateConfig(d, test.environ)
+
+		if d.failures != test.expectedFailures {
+			t.Errorf("%s: expected %d failures, but got %d: %s", test.name, test.expectedFailures, d.failures, stdout.String())
+		}
+		for _, expected := range test.expectedOutput {
+			if !strings.Contains(stdout.String(), expected) {
+				t.Errorf("%s: expected output to contain '%s', but got '%s'", test.name, expected, stdout.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/a-h/jwtproxy/proxy"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// verifyCommand explains how the proxy would handle a token, e.g. when a caller reports a 401. It accepts
+// the same command line flags as the proxy, and reads the same environment variables and config file.
+func verifyCommand(args []string, stdout io.Writer) int {
+	// The proxy's flags are copied, so that -at isn't accepted by the proxy itself.
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	settings.flags.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	at := fs.String("at", "", "The time to validate the token at, e.g. 2024-01-01T00:00:00Z. Defaults to now.")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(stdout, "usage: jwtproxy verify [-at 2024-01-01T00:00:00Z] [flags] <token>")
+		return 2
+	}
+	settings = &settingSources{flags: fs, getenv: settings.getenv}
+
+	now := time.Now()
+	if *at != "" {
+		var err error
+		if now, err = time.Parse(time.RFC3339, *at); err != nil {
+			fmt.Fprintf(stdout, "invalid time '%s', expected RFC 3339 format, e.g. 2024-01-01T00:00:00Z\n", *at)
+			return 2
+		}
+	}
+	if err := settings.loadFile(); err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	keys, err := getKeys(os.Environ())
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+
+	// Accept a copy of the whole Authorization header value.
+	raw := strings.TrimSpace(fs.Arg(0))
+	if fields := strings.Fields(raw); len(fields) == 2 {
+		raw = fields[1]
+	}
+	printTokenSegments(stdout, raw)
+
+	jwksURLs, err := getJWKSURLs()
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	h, err := newJWTAuthHandler(newKeyProvider(proxy.NewKeyStore(keys), jwksURLs), nil, nil)
+	if err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	h.Now = func() time.Time { return now }
+	fmt.Fprintf(stdout, "Validation at %s:\n", now.UTC().Format(time.RFC3339))
+	if err := verifyToken(&diagnostics{w: stdout}, h, raw); err != nil {
+		fmt.Fprintf(stdout, "REJECTED: the proxy would return 401 Unauthorized: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, "ACCEPTED: the request would be passed to the remote URL")
+	return 0
+}
+
+// verifyToken prints each step of validating the token, and returns the error the proxy would return.
+// Checks which depend on the request, such as DPoP proofs, are reported as warnings.
+func verifyToken(d *diagnostics, h proxy.JWTAuthHandler, raw string) error {
+	claims, err := h.Validate(raw, func(step string, err error, detail string) {
+		switch {
+		case err != nil && detail != "":
+			d.fail(step, fmt.Errorf("%v (%s)", err, detail))
+		case err != nil:
+			d.fail(step, err)
+		default:
+			d.ok(step, "%s", detail)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	issuer, _ := claims["iss"].(string)
+	if h.CertificateBoundIssuers[issuer] {
+		d.warn("sender", "the issuer requires the token to be bound to the client certificate, which isn't checked")
+	}
+	if h.DPoPIssuers[issuer] {
+		d.warn("sender", "the issuer requires a DPoP proof, which isn't checked")
+	}
+	return nil
+}
+
+// printTokenSegments prints the decoded header and claims of the token, even if it isn't valid.
+func printTokenSegments(w io.Writer, raw string) {
+	parts := strings.Split(raw, ".")
+	for i, name := range []string{"Header", "Claims"} {
+		if i >= len(parts) {
+			break
+		}
+		var out bytes.Buffer
+		data, err := jwt.DecodeSegment(parts[i])
+		if err == nil {
+			err = json.Indent(&out, data, "", "  ")
+		}
+		if err != nil {
+			fmt.Fprintf(w, "%s: failed to decode with error %v\n\n", name, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n%s\n\n", name, out.String())
+	}
+}